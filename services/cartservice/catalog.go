@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Limits enforced on the contents of a shopping cart.
+const (
+	maxQtyPerSku  = 10
+	maxQtyPerCart = 50
+)
+
+// maxLookups is the number of products looked up at productservice at the same time
+const maxLookups = 8
+
+// Product represents a product in the productservice catalog
+type Product struct {
+	SKU      string `json:"sku"`
+	Name     string `json:"name"`
+	Price    int    `json:"price"`
+	TaxClass string `json:"tax_class"`
+	Weight   int    `json:"weight"`
+}
+
+// errProductNotFound is returned when productservice does not know a SKU.
+var errProductNotFound = errors.New("product not found")
+
+// catalogEntry is a cached productservice lookup. A nil product means the SKU does not exist.
+type catalogEntry struct {
+	product *Product
+	expires time.Time
+}
+
+// productCatalog looks up products at productservice and caches the results for a while,
+// so validating a cart does not cost a request per item every time.
+type productCatalog struct {
+	mu      sync.Mutex
+	baseURL string
+	ttl     time.Duration
+	client  *http.Client
+	entries map[string]catalogEntry
+}
+
+func newProductCatalog(baseURL string, ttl time.Duration) *productCatalog {
+	return &productCatalog{
+		baseURL: baseURL,
+		ttl:     ttl,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		entries: make(map[string]catalogEntry),
+	}
+}
+
+// lookup returns the product with the given SKU, or errProductNotFound if it does not exist.
+func (pc *productCatalog) lookup(sku string) (Product, error) {
+
+	// Serve from the cache if we can
+	pc.mu.Lock()
+	entry, ok := pc.entries[sku]
+	pc.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		if entry.product == nil {
+			return Product{}, errProductNotFound
+		}
+		return *entry.product, nil
+	}
+
+	// Ask productservice
+	u := fmt.Sprintf("%v/product/%v", pc.baseURL, url.PathEscape(sku))
+	resp, err := pc.client.Get(u)
+	if err != nil {
+		return Product{}, err
+	}
+	defer resp.Body.Close()
+
+	// Read HTTP body
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Product{}, err
+	}
+
+	entry = catalogEntry{expires: time.Now().Add(pc.ttl)}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var product Product
+		if err := json.Unmarshal(result, &product); err != nil {
+			return Product{}, err
+		}
+		entry.product = &product
+	case http.StatusNotFound:
+		// Remember that the product does not exist
+	default:
+		return Product{}, fmt.Errorf("productservice returned status %v: %s", resp.StatusCode, result)
+	}
+
+	pc.mu.Lock()
+	pc.entries[sku] = entry
+	pc.mu.Unlock()
+
+	if entry.product == nil {
+		return Product{}, errProductNotFound
+	}
+	return *entry.product, nil
+}
+
+// lookupAll looks up the products with the given SKUs, asking productservice for up to maxLookups of them
+// at the same time. SKUs that do not exist, and empty ones, are left out of the result.
+func (pc *productCatalog) lookupAll(skus []string) (map[string]Product, error) {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		products = make(map[string]Product)
+		slots    = make(chan struct{}, maxLookups)
+		seen     = make(map[string]bool)
+	)
+	for _, sku := range skus {
+		if sku == "" || seen[sku] {
+			continue
+		}
+		seen[sku] = true
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(sku string) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			product, err := pc.lookup(sku)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				products[sku] = product
+			} else if err != errProductNotFound && firstErr == nil {
+				firstErr = err
+			}
+		}(sku)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return products, nil
+}
+
+// skus returns the SKUs of items.
+func skus(items []Item) []string {
+	var skus []string
+	for _, i := range items {
+		skus = append(skus, i.Sku)
+	}
+	return skus
+}
+
+// FieldError describes why a single field of a request failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validateCart checks the items that are about to be stored in the cart stored under key.
+// When allowRemoval is set, items with a quantity of 0 are accepted as removals.
+// It returns a FieldError for every problem with the items, and an error if the catalog could not be reached.
+func validateCart(key string, cart Cart, allowRemoval bool) ([]FieldError, error) {
+	var fieldErrors []FieldError
+
+	// Check the quantities and SKUs of the new items
+	products, err := catalog.lookupAll(skus(cart.Items))
+	if err != nil {
+		return nil, err
+	}
+	for n, i := range cart.Items {
+		field := fmt.Sprintf("items[%v]", n)
+		if i.Qty == 0 && allowRemoval {
+			continue
+		}
+		if i.Qty < 1 {
+			fieldErrors = append(fieldErrors, FieldError{field + ".qty", "must be at least 1"})
+		} else if i.Qty > maxQtyPerSku {
+			fieldErrors = append(fieldErrors, FieldError{field + ".qty", fmt.Sprintf("must be at most %v", maxQtyPerSku)})
+		}
+
+		if i.Sku == "" {
+			fieldErrors = append(fieldErrors, FieldError{field + ".sku", "is required"})
+			continue
+		}
+		if _, ok := products[i.Sku]; !ok {
+			fieldErrors = append(fieldErrors, FieldError{field + ".sku", "unknown product"})
+		}
+	}
+	if len(fieldErrors) > 0 {
+		return fieldErrors, nil
+	}
+
+	// Check the size of the cart once the new items are added
+	existing, _, err := loadCart(key)
+	if err != nil {
+		return nil, err
+	}
+	quantities := make(map[string]int)
+	for _, i := range existing.Items {
+		quantities[i.Sku] = i.Qty
+	}
+	for _, i := range cart.Items {
+		quantities[i.Sku] = i.Qty
+	}
+	var total int
+	for _, qty := range quantities {
+		total += qty
+	}
+	if total > maxQtyPerCart {
+		fieldErrors = append(fieldErrors, FieldError{"items", fmt.Sprintf("a cart may contain at most %v items", maxQtyPerCart)})
+	}
+
+	return fieldErrors, nil
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// Coupon rule types
+const (
+	couponPercentage   = "percentage"
+	couponFixed        = "fixed"
+	couponBuyXGetY     = "buy_x_get_y"
+	couponFreeShipping = "free_shipping"
+)
+
+// Coupon represents a promo code and the rules that decide when and how it applies.
+// All amounts are in cents.
+type Coupon struct {
+	Code string `json:"code" binding:"required"`
+	Type string `json:"type" binding:"required"`
+
+	// Percent is the discount of a percentage coupon, e.g. 10 for 10% off
+	Percent int `json:"percent,omitempty"`
+	// Amount is the discount of a fixed amount coupon
+	Amount int `json:"amount,omitempty"`
+	// For every BuyQty of Sku in the cart, FreeQty more of them are free
+	Sku     string `json:"sku,omitempty"`
+	BuyQty  int    `json:"buy_qty,omitempty"`
+	FreeQty int    `json:"free_qty,omitempty"`
+
+	// The coupon can only be applied between ValidFrom and ValidUntil, if set
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+	// UsageLimit is the number of carts the coupon can be applied to, 0 means unlimited
+	UsageLimit int `json:"usage_limit,omitempty"`
+	// MinBasket is the subtotal a cart needs before the coupon applies
+	MinBasket int `json:"min_basket,omitempty"`
+}
+
+// Discount is a coupon applied to a cart and the amount it takes off
+type Discount struct {
+	Code         string `json:"code"`
+	Type         string `json:"type"`
+	Amount       int    `json:"amount"`
+	FreeShipping bool   `json:"free_shipping,omitempty"`
+}
+
+// CouponRequest represents the payload to apply a coupon to a cart
+type CouponRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// couponKey returns the Redis key of a coupon definition.
+func couponKey(code string) string {
+	return "coupon:" + code
+}
+
+// couponUsesKey returns the Redis key counting the carts a coupon is applied to.
+func couponUsesKey(code string) string {
+	return "coupon:" + code + ":uses"
+}
+
+// couponsKey returns the Redis key of the set of coupon codes applied to the cart stored under key.
+func couponsKey(key string) string {
+	return key + ":coupons"
+}
+
+// normalizeCode makes coupon codes case insensitive.
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// validate checks that the coupon has everything its rule type needs.
+func (cp Coupon) validate() []FieldError {
+	var fieldErrors []FieldError
+	switch cp.Type {
+	case couponPercentage:
+		if cp.Percent < 1 || cp.Percent > 100 {
+			fieldErrors = append(fieldErrors, FieldError{"percent", "must be between 1 and 100"})
+		}
+	case couponFixed:
+		if cp.Amount < 1 {
+			fieldErrors = append(fieldErrors, FieldError{"amount", "must be at least 1"})
+		}
+	case couponBuyXGetY:
+		if cp.Sku == "" {
+			fieldErrors = append(fieldErrors, FieldError{"sku", "is required"})
+		}
+		if cp.BuyQty < 1 {
+			fieldErrors = append(fieldErrors, FieldError{"buy_qty", "must be at least 1"})
+		}
+		if cp.FreeQty < 1 {
+			fieldErrors = append(fieldErrors, FieldError{"free_qty", "must be at least 1"})
+		}
+	case couponFreeShipping:
+	default:
+		fieldErrors = append(fieldErrors, FieldError{"type", fmt.Sprintf("must be one of %v, %v, %v or %v",
+			couponPercentage, couponFixed, couponBuyXGetY, couponFreeShipping)})
+	}
+	if cp.ValidFrom != nil && cp.ValidUntil != nil && cp.ValidUntil.Before(*cp.ValidFrom) {
+		fieldErrors = append(fieldErrors, FieldError{"valid_until", "must be after valid_from"})
+	}
+	if cp.UsageLimit < 0 {
+		fieldErrors = append(fieldErrors, FieldError{"usage_limit", "must not be negative"})
+	}
+	if cp.MinBasket < 0 {
+		fieldErrors = append(fieldErrors, FieldError{"min_basket", "must not be negative"})
+	}
+	return fieldErrors
+}
+
+// activeAt returns why the coupon cannot be used at time t, or an empty string if it can.
+func (cp Coupon) activeAt(t time.Time) string {
+	if cp.ValidFrom != nil && t.Before(*cp.ValidFrom) {
+		return "coupon is not valid yet"
+	}
+	if cp.ValidUntil != nil && t.After(*cp.ValidUntil) {
+		return "coupon has expired"
+	}
+	return ""
+}
+
+// discount calculates what the coupon takes off a cart with the given subtotal.
+// The second return value is false if the cart does not qualify for the coupon.
+func (cp Coupon) discount(items []Item, prices map[string]int, subtotal int) (Discount, bool) {
+	if subtotal < cp.MinBasket {
+		return Discount{}, false
+	}
+
+	d := Discount{Code: cp.Code, Type: cp.Type}
+	switch cp.Type {
+	case couponPercentage:
+		d.Amount = subtotal * cp.Percent / 100
+	case couponFixed:
+		d.Amount = cp.Amount
+	case couponBuyXGetY:
+		for _, i := range items {
+			if i.Sku == cp.Sku {
+				d.Amount = i.Qty / (cp.BuyQty + cp.FreeQty) * cp.FreeQty * prices[i.Sku]
+			}
+		}
+		if d.Amount == 0 {
+			return Discount{}, false
+		}
+	case couponFreeShipping:
+		d.FreeShipping = true
+	}
+	return d, true
+}
+
+// subtotal counts up the price of the items before discounts.
+func subtotal(items []Item, prices map[string]int) int {
+	var total int
+	for _, i := range items {
+		total += prices[i.Sku] * i.Qty
+	}
+	return total
+}
+
+// computeDiscounts works out the discounts of the given coupons on a cart.
+// Coupons the cart does not qualify for are left out, and the discounts never exceed the subtotal.
+func computeDiscounts(items []Item, prices map[string]int, coupons []Coupon, now time.Time) []Discount {
+	total := subtotal(items, prices)
+
+	var discounts []Discount
+	remaining := total
+	for _, cp := range coupons {
+		if cp.activeAt(now) != "" {
+			continue
+		}
+		d, ok := cp.discount(items, prices, total)
+		if !ok {
+			continue
+		}
+		if d.Amount > remaining {
+			d.Amount = remaining
+		}
+		remaining -= d.Amount
+		discounts = append(discounts, d)
+	}
+	return discounts
+}
+
+// loadCoupon reads a coupon definition from Redis. Returns redis.Nil if the coupon does not exist.
+func loadCoupon(code string) (Coupon, error) {
+	result, err := rclient.Get(couponKey(code)).Bytes()
+	if err != nil {
+		return Coupon{}, err
+	}
+	var cp Coupon
+	err = json.Unmarshal(result, &cp)
+	return cp, err
+}
+
+// cartCoupons returns all coupons applied to the cart stored under key, ordered by code.
+func cartCoupons(key string) ([]Coupon, error) {
+	codes, err := rclient.SMembers(couponsKey(key)).Result()
+	if err != nil || len(codes) == 0 {
+		return nil, err
+	}
+	sort.Strings(codes)
+
+	var coupons []Coupon
+	for _, code := range codes {
+		cp, err := loadCoupon(code)
+		if err == redis.Nil {
+			// The coupon was withdrawn
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, cp)
+	}
+	return coupons, nil
+}
+
+// cartSubtotal returns the subtotal of the cart stored under key.
+func cartSubtotal(key string) (int, error) {
+	cart, _, err := loadCart(key)
+	if err != nil {
+		return 0, err
+	}
+	prices, err := cartPrices(cart)
+	if err != nil {
+		return 0, err
+	}
+	return subtotal(cart.Items, prices), nil
+}
+
+// cartPrices looks up the price of every item in a cart. Products that no longer exist cost nothing.
+func cartPrices(cart Cart) (map[string]int, error) {
+	products, err := catalog.lookupAll(skus(cart.Items))
+	if err != nil {
+		return nil, err
+	}
+	prices := make(map[string]int)
+	for sku, product := range products {
+		prices[sku] = product.Price
+	}
+	return prices, nil
+}
+
+// requireAdmin only lets requests through that carry the admin token as a bearer token. Without an admin
+// token configured, nobody gets through.
+func requireAdmin(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if len(adminToken) == 0 || subtle.ConstantTimeCompare([]byte(token), adminToken) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error": "a valid admin token is required",
+		})
+	}
+}
+
+// createCoupon adds a new coupon definition. Only admins can create coupons.
+func createCoupon(c *gin.Context) {
+
+	// Get the JSON data
+	var cp Coupon
+	if err := c.ShouldBindJSON(&cp); err != nil {
+		log.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	cp.Code = normalizeCode(cp.Code)
+	cp.Sku = strings.TrimSpace(cp.Sku)
+	if fieldErrors := cp.validate(); len(fieldErrors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":  "invalid coupon",
+			"fields": fieldErrors,
+		})
+		return
+	}
+
+	// Store the coupon, unless there already is one with this code
+	payload, _ := json.Marshal(cp)
+	created, err := rclient.SetNX(couponKey(cp.Code), payload, 0).Result()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"coupon": cp,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if !created {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "a coupon with this code already exists",
+		})
+		return
+	}
+
+	// Return the created coupon
+	log.WithFields(log.Fields{
+		"coupon": cp,
+	}).Info("Created coupon")
+	c.JSON(
+		http.StatusCreated,
+		cp,
+	)
+}
+
+// applyCoupon applies a coupon to a shopping cart.
+// Applying a coupon counts towards its usage limit until it is removed from the cart again.
+func applyCoupon(c *gin.Context) {
+
+	// Get the session ID
+	sessionid := cartKeyOf(c)
+
+	// Get the JSON data
+	var req CouponRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	code := normalizeCode(req.Code)
+	invalid := func(message string) {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":  message,
+			"fields": []FieldError{{"code", message}},
+		})
+	}
+
+	// Get the coupon
+	cp, err := loadCoupon(code)
+	if err == redis.Nil {
+		invalid("unknown coupon")
+		return
+	} else if err != nil {
+		log.WithFields(log.Fields{
+			"code": code,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Check if the coupon can be used right now
+	if reason := cp.activeAt(time.Now()); reason != "" {
+		invalid(reason)
+		return
+	}
+
+	// Check if the cart is big enough for the coupon
+	if cp.MinBasket > 0 {
+		subtotal, err := cartSubtotal(sessionid)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"sessionid": sessionid,
+			}).Error(err)
+			c.JSON(http.StatusBadGateway, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		if subtotal < cp.MinBasket {
+			invalid(fmt.Sprintf("coupon requires a basket of at least %v", cp.MinBasket))
+			return
+		}
+	}
+
+	// Applying the same coupon twice is fine
+	applied, err := rclient.SIsMember(couponsKey(sessionid), code).Result()
+	if err == nil && applied {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		return
+	}
+
+	// Claim one use of the coupon
+	uses, err := rclient.Incr(couponUsesKey(code)).Result()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"code": code,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if cp.UsageLimit > 0 && uses > int64(cp.UsageLimit) {
+		rclient.Decr(couponUsesKey(code))
+		invalid("coupon has been used up")
+		return
+	}
+
+	// Add the coupon to the cart
+	version, err := updateCart(sessionid, c.GetHeader("If-Match"), func(_ *redis.Tx, pipe redis.Pipeliner) error {
+		pipe.SAdd(couponsKey(sessionid), code)
+		return nil
+	})
+	if err != nil {
+		rclient.Decr(couponUsesKey(code))
+		abortWithUpdateError(c, sessionid, err)
+		return
+	}
+
+	// Return status created
+	log.WithFields(log.Fields{
+		"code":      code,
+		"sessionid": sessionid,
+	}).Info("Applied coupon to cart")
+	c.Header("ETag", etag(version))
+	c.JSON(
+		http.StatusCreated,
+		gin.H{
+			"status": "ok",
+		},
+	)
+}
+
+// removeCoupon removes a coupon from a shopping cart and gives back its use.
+func removeCoupon(c *gin.Context) {
+
+	// Get the session ID and coupon code
+	sessionid := cartKeyOf(c)
+	code := normalizeCode(c.Param("code"))
+
+	// Remove the coupon from the cart
+	var removed *redis.IntCmd
+	version, err := updateCart(sessionid, c.GetHeader("If-Match"), func(_ *redis.Tx, pipe redis.Pipeliner) error {
+		removed = pipe.SRem(couponsKey(sessionid), code)
+		return nil
+	})
+	if err != nil {
+		abortWithUpdateError(c, sessionid, err)
+		return
+	}
+	if removed.Val() == 1 {
+		rclient.Decr(couponUsesKey(code))
+	}
+
+	// Return coupon removed message
+	log.WithFields(log.Fields{
+		"code":      code,
+		"sessionid": sessionid,
+	}).Info("Removed coupon from cart")
+	c.Header("ETag", etag(version))
+	c.JSON(
+		http.StatusOK,
+		gin.H{"status": "ok"},
+	)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// keepAliveInterval is how often an idle event stream sends a ping, so proxies do not close it.
+const keepAliveInterval = 30 * time.Second
+
+// CartEvent is published whenever a cart changes
+type CartEvent struct {
+	Version int64 `json:"version"`
+	Count   int   `json:"count"`
+}
+
+// eventsChannel returns the Redis pub/sub channel on which changes to the cart stored under key are published.
+func eventsChannel(key string) string {
+	return key + ":events"
+}
+
+// cartEvent reads the current version and number of items of the cart stored under key.
+func cartEvent(key string) (CartEvent, error) {
+	cart, version, err := loadCart(key)
+	if err != nil {
+		return CartEvent{}, err
+	}
+	event := CartEvent{Version: version}
+	for _, i := range cart.Items {
+		event.Count += i.Qty
+	}
+	return event, nil
+}
+
+// publishCartEvent tells everyone listening that the cart stored under key has changed.
+// Failing to do so does not fail the change itself, so errors are only logged.
+func publishCartEvent(key string) {
+	event, err := cartEvent(key)
+	if err == nil {
+		payload, _ := json.Marshal(event)
+		err = rclient.Publish(eventsChannel(key), payload).Err()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sessionid": key,
+		}).Warn(err)
+	}
+}
+
+// streamEvents streams changes to a shopping cart as Server-Sent Events. The current state of the cart is
+// sent as soon as the stream opens, followed by a "cart" event every time the cart changes.
+func streamEvents(c *gin.Context) {
+
+	// Get the session ID
+	sessionid := cartKeyOf(c)
+
+	// Subscribe before reading the current state, so no change can slip in between
+	pubsub := rclient.Subscribe(eventsChannel(sessionid))
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(); err != nil {
+		log.WithFields(log.Fields{
+			"sessionid": sessionid,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	event, err := cartEvent(sessionid)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sessionid": sessionid,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Stream the events until the client goes away
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("cart", event)
+	c.Writer.Flush()
+	messages := pubsub.Channel()
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return false
+			}
+			c.SSEvent("cart", msg.Payload)
+			return true
+		case <-ticker.C:
+			c.SSEvent("ping", "")
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
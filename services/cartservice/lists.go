@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// The named lists a shopper can park items on, next to the active cart.
+const (
+	listSaved    = "saved"
+	listWishlist = "wishlist"
+)
+
+// lists contains the names of all lists, in the order they are merged.
+var lists = []string{listSaved, listWishlist}
+
+// activeCart is the name used to refer to the active cart when moving items around.
+const activeCart = "cart"
+
+// errInvalidItems is returned from a cart update that was refused because of the items involved.
+var errInvalidItems = errors.New("invalid items")
+
+// Move represents a request to move an item between the active cart and a list
+type Move struct {
+	Sku  string `json:"sku" binding:"required"`
+	From string `json:"from" binding:"required"`
+	To   string `json:"to" binding:"required"`
+}
+
+// listKey returns the Redis key of a named list belonging to the cart stored under key.
+// Lists are hashes of SKUs and quantities, just like the cart itself.
+func listKey(key, name string) string {
+	return key + ":list:" + name
+}
+
+// isList reports whether there is a list with the given name.
+func isList(name string) bool {
+	for _, l := range lists {
+		if l == name {
+			return true
+		}
+	}
+	return false
+}
+
+// itemsKey returns the Redis key holding the items of the active cart or of a named list.
+// The second return value is false if there is no list with that name.
+func itemsKey(key, name string) (string, bool) {
+	if name == activeCart {
+		return key, true
+	}
+	if isList(name) {
+		return listKey(key, name), true
+	}
+	return "", false
+}
+
+// getList gets all items on a list and returns them as JSON.
+func getList(c *gin.Context) {
+
+	// Get the session ID and the list
+	sessionid := cartKeyOf(c)
+	if !isList(c.Param("list")) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "no such list",
+		})
+		return
+	}
+	key := listKey(sessionid, c.Param("list"))
+
+	// Get all items on the list
+	list, _, err := loadCart(key)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sessionid": sessionid,
+			"list":      c.Param("list"),
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Flag the items whose product has disappeared from the catalog
+	if products, err := catalog.lookupAll(skus(list.Items)); err == nil {
+		for n, i := range list.Items {
+			if _, ok := products[i.Sku]; !ok {
+				list.Items[n].Unavailable = true
+			}
+		}
+	}
+
+	// Return the data
+	c.JSON(
+		http.StatusOK,
+		list,
+	)
+}
+
+// addToList adds an item or items to a list.
+func addToList(c *gin.Context) {
+
+	// Get the session ID and the list
+	sessionid := cartKeyOf(c)
+	if !isList(c.Param("list")) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "no such list",
+		})
+		return
+	}
+	key := listKey(sessionid, c.Param("list"))
+
+	// Unmarshal the JSON data from the body
+	var list Cart
+	if err := c.ShouldBindJSON(&list); err != nil {
+		log.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Lists follow the same rules as the cart
+	fieldErrors, err := validateCart(key, list, false)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"list":      list,
+			"sessionid": sessionid,
+		}).Error(err)
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":  "invalid list items",
+			"fields": fieldErrors,
+		})
+		return
+	}
+
+	// Add all the Items to the list in Redis
+	now := time.Now().UnixNano()
+	version, err := updateCart(sessionid, c.GetHeader("If-Match"), func(_ *redis.Tx, pipe redis.Pipeliner) error {
+		for _, i := range list.Items {
+			pipe.HSet(key, i.Sku, i.Qty)
+			pipe.HSet(updatedKey(key), i.Sku, now)
+		}
+		return nil
+	})
+	if err != nil {
+		abortWithUpdateError(c, sessionid, err)
+		return
+	}
+
+	// Return status created
+	log.WithFields(log.Fields{
+		"list":      c.Param("list"),
+		"items":     list.Items,
+		"sessionid": sessionid,
+	}).Info("Added item(s) to list")
+	c.Header("ETag", etag(version))
+	c.JSON(
+		http.StatusCreated,
+		gin.H{
+			"status": "ok",
+		},
+	)
+}
+
+// removeFromList removes a single item from a list.
+func removeFromList(c *gin.Context) {
+
+	// Get the session ID and the list
+	sessionid := cartKeyOf(c)
+	sku := c.Param("sku")
+	if !isList(c.Param("list")) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "no such list",
+		})
+		return
+	}
+	key := listKey(sessionid, c.Param("list"))
+
+	// Remove the item from the list in Redis
+	version, err := updateCart(sessionid, c.GetHeader("If-Match"), func(_ *redis.Tx, pipe redis.Pipeliner) error {
+		pipe.HDel(key, sku)
+		pipe.HDel(updatedKey(key), sku)
+		return nil
+	})
+	if err != nil {
+		abortWithUpdateError(c, sessionid, err)
+		return
+	}
+
+	// Return item removed message
+	log.WithFields(log.Fields{
+		"list":      c.Param("list"),
+		"sku":       sku,
+		"sessionid": sessionid,
+	}).Info("Removed item from list")
+	c.Header("ETag", etag(version))
+	c.JSON(
+		http.StatusOK,
+		gin.H{"status": "ok"},
+	)
+}
+
+// moveItem moves an item from the active cart to a list, from a list to the active cart, or between two lists.
+// The whole quantity is moved and added to whatever quantity the destination already holds.
+func moveItem(c *gin.Context) {
+
+	// Get the session ID
+	sessionid := cartKeyOf(c)
+
+	// Unmarshal the JSON data from the body
+	var move Move
+	if err := c.ShouldBindJSON(&move); err != nil {
+		log.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	from, okFrom := itemsKey(sessionid, move.From)
+	to, okTo := itemsKey(sessionid, move.To)
+	if !okFrom || !okTo || from == to {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("can only move items between %v and the lists %v", activeCart, lists),
+		})
+		return
+	}
+
+	// Moving an item to the active cart makes it purchasable again, so it has to follow the cart rules
+	if to == sessionid {
+		if _, err := catalog.lookup(move.Sku); err == errProductNotFound {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":  "invalid cart items",
+				"fields": []FieldError{{"sku", "unknown product"}},
+			})
+			return
+		} else if err != nil {
+			log.WithFields(log.Fields{
+				"sku": move.Sku,
+			}).Error(err)
+			c.JSON(http.StatusBadGateway, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	// Move the item in a single transaction
+	var fieldErrors []FieldError
+	now := time.Now().UnixNano()
+	version, err := updateCart(sessionid, c.GetHeader("If-Match"), func(tx *redis.Tx, pipe redis.Pipeliner) error {
+		fieldErrors = nil
+		qty, err := tx.HGet(from, move.Sku).Int()
+		if err == redis.Nil {
+			fieldErrors = append(fieldErrors, FieldError{"sku", fmt.Sprintf("is not in %v", move.From)})
+			return errInvalidItems
+		} else if err != nil {
+			return err
+		}
+		existing, err := tx.HGet(to, move.Sku).Int()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if qty+existing > maxQtyPerSku {
+			fieldErrors = append(fieldErrors, FieldError{"sku", fmt.Sprintf("%v may contain at most %v of this item", move.To, maxQtyPerSku)})
+			return errInvalidItems
+		}
+		if to == sessionid {
+			quantities, err := tx.HVals(to).Result()
+			if err != nil {
+				return err
+			}
+			total := qty
+			for _, q := range quantities {
+				n, _ := strconv.Atoi(q)
+				total += n
+			}
+			if total > maxQtyPerCart {
+				fieldErrors = append(fieldErrors, FieldError{"items", fmt.Sprintf("a cart may contain at most %v items", maxQtyPerCart)})
+				return errInvalidItems
+			}
+		}
+
+		pipe.HDel(from, move.Sku)
+		pipe.HDel(updatedKey(from), move.Sku)
+		pipe.HSet(to, move.Sku, qty+existing)
+		pipe.HSet(updatedKey(to), move.Sku, now)
+		return nil
+	})
+	if err == errInvalidItems {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":  "invalid move",
+			"fields": fieldErrors,
+		})
+		return
+	}
+	if err != nil {
+		abortWithUpdateError(c, sessionid, err)
+		return
+	}
+
+	// Return item moved message
+	log.WithFields(log.Fields{
+		"move":      move,
+		"sessionid": sessionid,
+	}).Info("Moved item")
+	c.Header("ETag", etag(version))
+	c.JSON(
+		http.StatusOK,
+		gin.H{"status": "ok"},
+	)
+}
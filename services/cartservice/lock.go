@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// lockTTL is how long a checkout may keep a cart locked. The lock is released automatically
+// afterwards, so a checkout that crashed does not freeze the cart forever.
+const lockTTL = 5 * time.Minute
+
+// Snapshot is the content of a cart at the moment it was locked for checkout
+type Snapshot struct {
+	ID      string    `json:"id"`
+	Items   []Item    `json:"items"`
+	Coupons []string  `json:"coupons"`
+	Version int64     `json:"version"`
+	Expires time.Time `json:"expires"`
+}
+
+// unlockScript releases a cart lock, but only if it is still held for the given snapshot.
+// KEYS: those returned by unlockKeys. ARGV: the snapshot ID and '1' to empty the cart as well.
+// Returns 1 if the lock was released, 0 if the cart was not locked and -1 if it is locked for another snapshot.
+var unlockScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if not current then
+	return 0
+end
+if current ~= ARGV[1] then
+	return -1
+end
+redis.call('DEL', KEYS[1])
+if ARGV[2] == '1' then
+	redis.call('DEL', KEYS[2], KEYS[3], KEYS[4])
+	redis.call('INCR', KEYS[5])
+end
+return 1
+`)
+
+// unlockKeys returns the keys unlockScript needs for the cart stored under key.
+func unlockKeys(key string) []string {
+	return []string{lockKey(key), key, updatedKey(key), couponsKey(key), versionKey(key)}
+}
+
+// lockKey returns the Redis key that is set while the cart stored under key is being checked out.
+// It holds the ID of the snapshot that was taken when the cart was locked.
+func lockKey(key string) string {
+	return key + ":lock"
+}
+
+// snapshotKey returns the Redis key of a snapshot of the cart stored under key.
+func snapshotKey(key, id string) string {
+	return key + ":snapshot:" + id
+}
+
+// loadSnapshot reads a snapshot of the cart stored under key. Returns redis.Nil if it does not exist (anymore).
+func loadSnapshot(key, id string) (Snapshot, error) {
+	result, err := rclient.Get(snapshotKey(key, id)).Bytes()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	var snapshot Snapshot
+	err = json.Unmarshal(result, &snapshot)
+	return snapshot, err
+}
+
+// priceSnapshot prices a snapshot with the coupons it was taken with.
+func priceSnapshot(snapshot Snapshot) (Quote, error) {
+	var coupons []Coupon
+	for _, code := range snapshot.Coupons {
+		coupon, err := loadCoupon(code)
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return Quote{}, err
+		}
+		coupons = append(coupons, coupon)
+	}
+	return priceItems(Cart{Items: snapshot.Items}, coupons)
+}
+
+// lockCart locks a shopping cart for checkout and returns the ID of a snapshot of its content.
+// Until the cart is unlocked, or the lock expires, every change to the cart is refused with 423 Locked.
+func lockCart(c *gin.Context) {
+
+	// Get the session ID
+	sessionid := cartKeyOf(c)
+
+	// Take the lock, only one checkout can hold it
+	id, err := randomID()
+	if err != nil {
+		abortWithUpdateError(c, sessionid, err)
+		return
+	}
+	ok, err := rclient.SetNX(lockKey(sessionid), id, lockTTL).Result()
+	if err != nil {
+		abortWithUpdateError(c, sessionid, err)
+		return
+	}
+	if !ok {
+		abortWithUpdateError(c, sessionid, errCartLocked)
+		return
+	}
+
+	// Nothing can change the cart anymore, so take the snapshot
+	snapshot := Snapshot{ID: id, Expires: time.Now().Add(lockTTL).UTC()}
+	cart, version, err := loadCart(sessionid)
+	if err == nil {
+		snapshot.Items, snapshot.Version = cart.Items, version
+		snapshot.Coupons, err = rclient.SMembers(couponsKey(sessionid)).Result()
+		sort.Strings(snapshot.Coupons)
+	}
+	if err == nil {
+		payload, _ := json.Marshal(snapshot)
+		err = rclient.Set(snapshotKey(sessionid, id), payload, lockTTL).Err()
+	}
+	if err != nil {
+		unlockScript.Run(rclient, unlockKeys(sessionid), id, "0")
+		abortWithUpdateError(c, sessionid, err)
+		return
+	}
+
+	// Return the snapshot
+	log.WithFields(log.Fields{
+		"sessionid": sessionid,
+		"snapshot":  id,
+	}).Info("Locked cart")
+	c.Header("ETag", etag(version))
+	c.JSON(
+		http.StatusCreated,
+		snapshot,
+	)
+}
+
+// unlockCart releases the checkout lock of a shopping cart. The snapshot the lock was taken for is passed as
+// ?snapshot=, so a checkout can never release a lock that has expired and was taken again by another checkout.
+// A checkout that went through passes ?clear=true to empty the cart in the same step, so nobody can change
+// the cart between the two.
+func unlockCart(c *gin.Context) {
+
+	// Get the session ID and snapshot
+	sessionid := cartKeyOf(c)
+	id := c.Query("snapshot")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "snapshot is required",
+		})
+		return
+	}
+
+	// Release the lock. The coupons of a locked cart cannot change, so those read now are the ones cleared.
+	clear := "0"
+	var codes []string
+	if c.Query("clear") == "true" {
+		clear = "1"
+		var err error
+		if codes, err = rclient.SMembers(couponsKey(sessionid)).Result(); err != nil {
+			abortWithUpdateError(c, sessionid, err)
+			return
+		}
+	}
+	released, err := unlockScript.Run(rclient, unlockKeys(sessionid), id, clear).Int()
+	if err != nil {
+		abortWithUpdateError(c, sessionid, err)
+		return
+	}
+	if released < 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "the cart is locked for another snapshot",
+		})
+		return
+	}
+
+	// The coupons of a cleared cart give back their use
+	if released == 1 && clear == "1" {
+		for _, code := range codes {
+			rclient.Decr(couponUsesKey(code))
+		}
+		cartChanged(sessionid)
+	}
+
+	// Return unlocked message
+	log.WithFields(log.Fields{
+		"sessionid": sessionid,
+		"snapshot":  id,
+		"cleared":   clear == "1",
+	}).Info("Unlocked cart")
+	c.JSON(
+		http.StatusOK,
+		gin.H{"status": "ok"},
+	)
+}
@@ -16,24 +16,31 @@ import (
 // Cart represents the shopping cart model
 type Cart struct {
 	Items []Item `json:"items" binding:"required"`
+
+	// Discounts lists the coupons applied to the cart, it is only filled when reading a cart
+	Discounts []Discount `json:"discounts,omitempty"`
 }
 
 // Item represents the items in a Cart
 type Item struct {
-	Sku string `json:"sku" binding:"required"`
-	Qty int    `json:"qty" binding:"required"`
+	Sku string `json:"sku"`
+	Qty int    `json:"qty"`
+
+	// Unavailable is set when the product is no longer in the catalog
+	Unavailable bool `json:"unavailable,omitempty"`
 }
 
 // addToCart adds an item or items to a shopping cart in Redis.
 // Shopping carts are identified by session IDs and contain Items. Each item contains the product SKU and quantity.
 // So, our Redis carts look like this:
-// sessionid: [
+// cart:<session id>: [
 // 	"sku1": 2,
 // 	"sku2": 3 ]
+// Next to every cart we keep a hash with the time each SKU was last updated, which is used when merging carts.
 func addToCart(c *gin.Context) {
 
 	// Get the session ID
-	sessionid := c.Param("sessionid")
+	sessionid := cartKeyOf(c)
 
 	// Unmarshal the JSON data from the body
 	var cart Cart
@@ -45,19 +52,38 @@ func addToCart(c *gin.Context) {
 		return
 	}
 
+	// Validate the items against the product catalog and our cart limits
+	fieldErrors, err := validateCart(sessionid, cart, false)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cart":      cart,
+			"sessionid": sessionid,
+		}).Error(err)
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":  "invalid cart items",
+			"fields": fieldErrors,
+		})
+		return
+	}
+
 	// Add all the Items in the Cart to Redis
-	for _, i := range cart.Items {
-		err := rclient.HSet(sessionid, i.Sku, i.Qty).Err()
-		if err != nil {
-			log.WithFields(log.Fields{
-				"item":      i,
-				"sessionid": sessionid,
-			}).Error(err)
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": err.Error(),
-			})
-			return
+	now := time.Now().UnixNano()
+	version, err := updateCart(sessionid, c.GetHeader("If-Match"), func(_ *redis.Tx, pipe redis.Pipeliner) error {
+		for _, i := range cart.Items {
+			pipe.HSet(sessionid, i.Sku, i.Qty)
+			pipe.HSet(updatedKey(sessionid), i.Sku, now)
 		}
+		return nil
+	})
+	if err != nil {
+		abortWithUpdateError(c, sessionid, err)
+		return
 	}
 
 	// Return status created
@@ -65,6 +91,7 @@ func addToCart(c *gin.Context) {
 		"cart":      cart,
 		"sessionid": sessionid,
 	}).Info("Added item(s) to cart")
+	c.Header("ETag", etag(version))
 	c.JSON(
 		http.StatusCreated,
 		gin.H{
@@ -73,14 +100,81 @@ func addToCart(c *gin.Context) {
 	)
 }
 
+// updateItems changes the quantities of items in a shopping cart. Items with a quantity of 0 are removed.
+func updateItems(c *gin.Context) {
+
+	// Get the session ID
+	sessionid := cartKeyOf(c)
+
+	// Unmarshal the JSON data from the body
+	var cart Cart
+	if err := c.ShouldBindJSON(&cart); err != nil {
+		log.Error(err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Validate the items against the product catalog and our cart limits
+	fieldErrors, err := validateCart(sessionid, cart, true)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"cart":      cart,
+			"sessionid": sessionid,
+		}).Error(err)
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":  "invalid cart items",
+			"fields": fieldErrors,
+		})
+		return
+	}
+
+	// Update the Items in Redis
+	now := time.Now().UnixNano()
+	version, err := updateCart(sessionid, c.GetHeader("If-Match"), func(_ *redis.Tx, pipe redis.Pipeliner) error {
+		for _, i := range cart.Items {
+			if i.Qty == 0 {
+				pipe.HDel(sessionid, i.Sku)
+				pipe.HDel(updatedKey(sessionid), i.Sku)
+				continue
+			}
+			pipe.HSet(sessionid, i.Sku, i.Qty)
+			pipe.HSet(updatedKey(sessionid), i.Sku, now)
+		}
+		return nil
+	})
+	if err != nil {
+		abortWithUpdateError(c, sessionid, err)
+		return
+	}
+
+	// Return the updated version
+	log.WithFields(log.Fields{
+		"cart":      cart,
+		"sessionid": sessionid,
+	}).Info("Updated item(s) in cart")
+	c.Header("ETag", etag(version))
+	c.JSON(
+		http.StatusOK,
+		gin.H{"status": "ok"},
+	)
+}
+
 // getCart gets all items from a shopping cart and returns them as JSON.
 func getCart(c *gin.Context) {
 
 	// Get the session ID
-	sessionid := c.Param("sessionid")
+	sessionid := cartKeyOf(c)
 
 	// Get all items in the shopping cart by session ID
-	result, err := rclient.HGetAll(sessionid).Result()
+	cart, version, err := loadCart(sessionid)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"sessionid": sessionid,
@@ -91,17 +185,30 @@ func getCart(c *gin.Context) {
 		return
 	}
 
-	// Convert to our Cart struct
-	var items []Item
-	for k, v := range result {
-		qty, _ := strconv.Atoi(v)
-		items = append(items, Item{k, qty})
+	// Flag the items whose product has disappeared from the catalog
+	if products, err := catalog.lookupAll(skus(cart.Items)); err != nil {
+		log.WithFields(log.Fields{
+			"sessionid": sessionid,
+		}).Warn(err)
+	} else {
+		for n, i := range cart.Items {
+			if _, ok := products[i.Sku]; !ok {
+				cart.Items[n].Unavailable = true
+			}
+		}
 	}
-	cart := Cart{
-		Items: items,
+
+	// Work out the discounts of the coupons applied to the cart
+	quote, err := priceCart(sessionid, cart)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sessionid": sessionid,
+		}).Warn(err)
 	}
+	cart.Discounts = quote.Discounts
 
 	// Return the data
+	c.Header("ETag", etag(version))
 	c.JSON(
 		http.StatusOK,
 		cart,
@@ -109,27 +216,62 @@ func getCart(c *gin.Context) {
 
 }
 
-// emptyCart empties a shopping cart by deleting the key in Redis.
+// loadCart reads the shopping cart stored under key from Redis, together with its version.
+func loadCart(key string) (Cart, int64, error) {
+	var result *redis.StringStringMapCmd
+	var version *redis.StringCmd
+	_, err := rclient.TxPipelined(func(pipe redis.Pipeliner) error {
+		result = pipe.HGetAll(key)
+		version = pipe.Get(versionKey(key))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return Cart{}, 0, err
+	}
+	v, err := version.Int64()
+	if err != nil && err != redis.Nil {
+		return Cart{}, 0, err
+	}
+
+	// Convert to our Cart struct
+	var items []Item
+	for k, v := range result.Val() {
+		qty, _ := strconv.Atoi(v)
+		items = append(items, Item{Sku: k, Qty: qty})
+	}
+	return Cart{Items: items}, v, nil
+}
+
+// emptyCart empties a shopping cart by deleting the key in Redis. The coupons applied to it give back their use.
 func emptyCart(c *gin.Context) {
 
 	// Get the session ID
-	sessionid := c.Param("sessionid")
+	sessionid := cartKeyOf(c)
 
 	// Delete the cart in Redis
-	if err := rclient.Del(sessionid).Err(); err != nil {
-		log.WithFields(log.Fields{
-			"sessionid": sessionid,
-		}).Error(err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": err.Error(),
-		})
+	var codes []string
+	version, err := updateCart(sessionid, c.GetHeader("If-Match"), func(tx *redis.Tx, pipe redis.Pipeliner) error {
+		var err error
+		codes, err = tx.SMembers(couponsKey(sessionid)).Result()
+		if err != nil {
+			return err
+		}
+		pipe.Del(sessionid, updatedKey(sessionid), couponsKey(sessionid))
+		return nil
+	})
+	if err != nil {
+		abortWithUpdateError(c, sessionid, err)
 		return
 	}
+	for _, code := range codes {
+		rclient.Decr(couponUsesKey(code))
+	}
 
 	// Return cart emptied message
 	log.WithFields(log.Fields{
 		"sessionid": sessionid,
 	}).Info("Deleted item(s) from cart")
+	c.Header("ETag", etag(version))
 	c.JSON(
 		http.StatusOK,
 		gin.H{"status": "ok"},
@@ -160,23 +302,85 @@ func setupRouter() *gin.Engine {
 	logger.SetOutput(os.Stdout)
 	router.Use(ginlogrus.Logger(logger), gin.Recovery())
 
-	router.GET("/cart/:sessionid", getCart)
-	router.POST("/cart/:sessionid", addToCart)
-	router.DELETE("/cart/:sessionid", emptyCart)
+	// Every cart route needs a valid session token
+	carts := router.Group("/cart/:sessionid", requireSession)
+	carts.GET("", getCart)
+	carts.POST("", addToCart)
+	carts.PATCH("", updateItems)
+	carts.DELETE("", emptyCart)
+	carts.GET("/quote", getQuote)
+	carts.GET("/events", streamEvents)
+	carts.POST("/merge", mergeCart)
+	carts.POST("/lock", lockCart)
+	carts.DELETE("/lock", unlockCart)
+	carts.POST("/move", moveItem)
+	carts.POST("/share", shareCart)
+	carts.POST("/copy", copySharedCart)
+	carts.GET("/lists/:list", getList)
+	carts.POST("/lists/:list", addToList)
+	carts.DELETE("/lists/:list/:sku", removeFromList)
+	carts.POST("/coupons", applyCoupon)
+	carts.DELETE("/coupons/:code", removeCoupon)
+	router.GET("/shared-cart/:token", getSharedCart)
+	router.POST("/coupons", requireAdmin, createCoupon)
 	router.GET("/health", healthCheck)
 	return router
 }
 
+// updatedKey returns the Redis key of the hash holding the last update time of every item in a cart.
+func updatedKey(key string) string {
+	return key + ":updated"
+}
+
+// abortWithUpdateError writes the response for an error returned by updateCart.
+func abortWithUpdateError(c *gin.Context, sessionid string, err error) {
+	if err == errVersionMismatch {
+		c.JSON(http.StatusPreconditionFailed, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err == errCartBusy {
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err == errCartLocked {
+		c.JSON(http.StatusLocked, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	log.WithFields(log.Fields{
+		"sessionid": sessionid,
+	}).Error(err)
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": err.Error(),
+	})
+}
+
 func healthCheck(c *gin.Context) {
 	c.String(200, "OK")
 }
 
-var rclient *redis.Client
+var (
+	rclient       *redis.Client
+	catalog       *productCatalog
+	shareSecret   []byte
+	sessionSecret []byte
+	adminToken    []byte
+)
 
-// init initializes our Redis database
+// init initializes our Redis database and the product catalog
 func init() {
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetOutput(os.Stdout)
+	catalog = newProductCatalog(mustMapEnv("PRODUCTSERVICE"), time.Minute)
+	shareSecret = []byte(mustMapEnv("SHARE_SECRET"))
+	sessionSecret = []byte(mustMapEnv("SESSION_SECRET"))
+	adminToken = []byte(os.Getenv("ADMIN_TOKEN"))
 	redisHost := mustMapEnv("REDIS_HOST")
 	rclient = redis.NewClient(&redis.Options{
 		Addr:     redisHost,
@@ -206,6 +410,14 @@ func init() {
 		}
 	}
 	log.Printf("Successfully connected to Redis on host '%v'...", redisHost)
+
+	// Move carts stored before keys were namespaced, a failure is retried on the next start
+	if err := migrateKeys(); err != nil {
+		log.Errorf("Could not migrate cart keys: %v", err)
+	}
+
+	// Keep a durable copy of the carts in Postgres, if configured
+	setupStore()
 }
 
 func main() {
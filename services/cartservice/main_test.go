@@ -2,15 +2,35 @@ package main
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// sessionID derives the UUID of an anonymous session from a readable name.
+func sessionID(name string) string {
+	sum := md5.Sum([]byte(name))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// sessionToken returns the session token frontendservice would issue for an anonymous session.
+func sessionToken(name string) string {
+	id := sessionID(name)
+	return id + "." + sign(sessionSecret, id)
+}
+
+// userToken returns the session token of the cart of a signed in user.
+func userToken(id string) string {
+	return "user:" + id + "." + sign(sessionSecret, "user:"+id)
+}
+
 func TestHealthCheck(t *testing.T) {
 	router := setupRouter()
 	w := httptest.NewRecorder()
@@ -28,8 +48,8 @@ func TestAddToCart(t *testing.T) {
 	w := httptest.NewRecorder()
 
 	items := Item{
-		Sku: "test",
-		Qty: 22,
+		Sku: "SKU1",
+		Qty: 2,
 	}
 	cart := Cart{
 		Items: []Item{
@@ -38,31 +58,592 @@ func TestAddToCart(t *testing.T) {
 	}
 
 	jsonpayload, _ := json.Marshal(cart)
-	req, _ := http.NewRequest("POST", "/cart/sessiontest", bytes.NewBuffer(jsonpayload))
+	req, _ := http.NewRequest("POST", "/cart/"+sessionToken("sessiontest"), bytes.NewBuffer(jsonpayload))
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, 201, w.Code)
 	assert.Equal(t, "{\"status\":\"ok\"}\n", w.Body.String())
 }
 
+func TestAddToCartInvalidItems(t *testing.T) {
+	router := setupRouter()
+	w := httptest.NewRecorder()
+
+	cart := Cart{
+		Items: []Item{
+			{Sku: "SKU1", Qty: 0},
+			{Sku: "doesnotexist", Qty: 1},
+		},
+	}
+
+	jsonpayload, _ := json.Marshal(cart)
+	req, _ := http.NewRequest("POST", "/cart/"+sessionToken("sessiontest"), bytes.NewBuffer(jsonpayload))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 422, w.Code)
+	assert.Contains(t, w.Body.String(), "\"field\":\"items[0].qty\"")
+	assert.Contains(t, w.Body.String(), "\"field\":\"items[1].sku\"")
+}
+
 func TestGetCart(t *testing.T) {
 	router := setupRouter()
 	w := httptest.NewRecorder()
 
-	req, _ := http.NewRequest("GET", "/cart/sessiontest", nil)
+	req, _ := http.NewRequest("GET", "/cart/"+sessionToken("sessiontest"), nil)
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, 200, w.Code)
-	assert.Equal(t, "{\"items\":[{\"sku\":\"test\",\"qty\":22}]}\n", w.Body.String())
+	assert.Equal(t, "{\"items\":[{\"sku\":\"SKU1\",\"qty\":2}]}\n", w.Body.String())
+	assert.NotEmpty(t, w.Header().Get("ETag"))
+}
+
+func TestAddToCartStaleVersion(t *testing.T) {
+	router := setupRouter()
+
+	// Read the cart to get its current version
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/cart/"+sessionToken("sessiontest"), nil)
+	router.ServeHTTP(w, req)
+	current := w.Header().Get("ETag")
+
+	cart := Cart{
+		Items: []Item{{Sku: "SKU1", Qty: 3}},
+	}
+	jsonpayload, _ := json.Marshal(cart)
+
+	// Another tab changes the cart in the meantime
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/cart/"+sessionToken("sessiontest"), bytes.NewBuffer(jsonpayload))
+	req.Header.Set("If-Match", current)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+
+	// So updating with the old version fails
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/cart/"+sessionToken("sessiontest"), bytes.NewBuffer(jsonpayload))
+	req.Header.Set("If-Match", current)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 412, w.Code)
 }
 
 func TestDeleteCart(t *testing.T) {
 	router := setupRouter()
 	w := httptest.NewRecorder()
 
-	req, _ := http.NewRequest("DELETE", "/cart/sessiontest", nil)
+	req, _ := http.NewRequest("DELETE", "/cart/"+sessionToken("sessiontest"), nil)
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, 200, w.Code)
 	assert.Equal(t, "{\"status\":\"ok\"}\n", w.Body.String())
 }
+
+func TestMergeCart(t *testing.T) {
+	router := setupRouter()
+
+	// Fill an anonymous cart and a user cart that share a SKU
+	for _, sc := range []struct {
+		path string
+		cart Cart
+	}{
+		{"/cart/" + userToken("mergetest"), Cart{Items: []Item{{Sku: "SKU1", Qty: 1}}}},
+		{"/cart/" + sessionToken("mergesession"), Cart{Items: []Item{{Sku: "SKU1", Qty: 2}}}},
+	} {
+		w := httptest.NewRecorder()
+		jsonpayload, _ := json.Marshal(sc.cart)
+		req, _ := http.NewRequest("POST", sc.path, bytes.NewBuffer(jsonpayload))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 201, w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/cart/"+sessionToken("mergesession")+"/merge?into="+userToken("mergetest")+"&strategy=sum", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "{\"items\":[{\"sku\":\"SKU1\",\"qty\":3}]}\n", w.Body.String())
+
+	// The anonymous cart is gone
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/cart/"+sessionToken("mergesession"), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "{\"items\":null}\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/cart/"+userToken("mergetest"), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestMergeCartLimits(t *testing.T) {
+	router := setupRouter()
+	for _, path := range []string{"/cart/" + userToken("mergelimits"), "/cart/" + sessionToken("mergelimits")} {
+		w := httptest.NewRecorder()
+		jsonpayload, _ := json.Marshal(Cart{Items: []Item{{Sku: "SKU1", Qty: 6}}})
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(jsonpayload))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 201, w.Code)
+	}
+
+	// Summing the carts would put more of an item in the cart than allowed, so nothing is merged
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/cart/"+sessionToken("mergelimits")+"/merge?into="+userToken("mergelimits"), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 422, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/cart/"+sessionToken("mergelimits"), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "{\"items\":[{\"sku\":\"SKU1\",\"qty\":6}]}\n", w.Body.String())
+
+	// Keeping the highest quantity fits
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/cart/"+sessionToken("mergelimits")+"/merge?into="+userToken("mergelimits")+"&strategy=max", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/cart/"+userToken("mergelimits"), nil)
+	router.ServeHTTP(w, req)
+}
+
+func TestMergeCartInvalidTarget(t *testing.T) {
+	router := setupRouter()
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("POST", "/cart/"+sessionToken("mergesession")+"/merge?into="+sessionToken("othersession"), nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestMoveItem(t *testing.T) {
+	router := setupRouter()
+
+	w := httptest.NewRecorder()
+	jsonpayload, _ := json.Marshal(Cart{Items: []Item{{Sku: "SKU2", Qty: 1}}})
+	req, _ := http.NewRequest("POST", "/cart/"+sessionToken("movesession"), bytes.NewBuffer(jsonpayload))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+
+	// Save the item for later
+	w = httptest.NewRecorder()
+	jsonpayload, _ = json.Marshal(Move{Sku: "SKU2", From: "cart", To: "saved"})
+	req, _ = http.NewRequest("POST", "/cart/"+sessionToken("movesession")+"/move", bytes.NewBuffer(jsonpayload))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/cart/"+sessionToken("movesession")+"/lists/saved", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "{\"items\":[{\"sku\":\"SKU2\",\"qty\":1}]}\n", w.Body.String())
+
+	// It is no longer in the cart, so it cannot be moved from there again
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/cart/"+sessionToken("movesession")+"/move", bytes.NewBuffer(jsonpayload))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 422, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/cart/"+sessionToken("movesession")+"/lists/saved/SKU2", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	// Moving an item into a full cart is refused
+	full := Cart{}
+	for _, sku := range []string{"SKU1", "SKU2", "SKU3", "SKU4", "SKU5"} {
+		full.Items = append(full.Items, Item{Sku: sku, Qty: 10})
+	}
+	for path, cart := range map[string]Cart{
+		"/cart/" + sessionToken("movesession"):                  full,
+		"/cart/" + sessionToken("movesession") + "/lists/saved": {Items: []Item{{Sku: "SKU6", Qty: 1}}},
+	} {
+		w = httptest.NewRecorder()
+		jsonpayload, _ = json.Marshal(cart)
+		req, _ = http.NewRequest("POST", path, bytes.NewBuffer(jsonpayload))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 201, w.Code)
+	}
+	w = httptest.NewRecorder()
+	jsonpayload, _ = json.Marshal(Move{Sku: "SKU6", From: "saved", To: "cart"})
+	req, _ = http.NewRequest("POST", "/cart/"+sessionToken("movesession")+"/move", bytes.NewBuffer(jsonpayload))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 422, w.Code)
+	assert.Contains(t, w.Body.String(), "at most 50 items")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/cart/"+sessionToken("movesession"), nil)
+	router.ServeHTTP(w, req)
+}
+
+func TestComputeDiscounts(t *testing.T) {
+	items := []Item{{Sku: "SKU1", Qty: 3}, {Sku: "SKU2", Qty: 1}}
+	prices := map[string]int{"SKU1": 1000, "SKU2": 500}
+	now := time.Now()
+	expired := now.Add(-time.Hour)
+
+	coupons := []Coupon{
+		{Code: "TENOFF", Type: couponPercentage, Percent: 10},
+		{Code: "TWOFORONE", Type: couponBuyXGetY, Sku: "SKU1", BuyQty: 1, FreeQty: 1},
+		{Code: "SHIPFREE", Type: couponFreeShipping},
+		{Code: "OLD", Type: couponFixed, Amount: 100, ValidUntil: &expired},
+		{Code: "BIGSPENDER", Type: couponFixed, Amount: 100, MinBasket: 10000},
+	}
+	discounts := computeDiscounts(items, prices, coupons, now)
+
+	assert.Equal(t, []Discount{
+		{Code: "TENOFF", Type: couponPercentage, Amount: 350},
+		{Code: "TWOFORONE", Type: couponBuyXGetY, Amount: 1000},
+		{Code: "SHIPFREE", Type: couponFreeShipping, FreeShipping: true},
+	}, discounts)
+}
+
+func TestApplyCoupon(t *testing.T) {
+	router := setupRouter()
+
+	w := httptest.NewRecorder()
+	jsonpayload, _ := json.Marshal(Coupon{Code: "tentest", Type: couponPercentage, Percent: 10})
+	req, _ := http.NewRequest("POST", "/coupons", bytes.NewBuffer(jsonpayload))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/coupons", bytes.NewBuffer(jsonpayload))
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("ADMIN_TOKEN"))
+	router.ServeHTTP(w, req)
+	assert.Contains(t, []int{201, 409}, w.Code)
+
+	w = httptest.NewRecorder()
+	jsonpayload, _ = json.Marshal(Cart{Items: []Item{{Sku: "SKU1", Qty: 1}}})
+	req, _ = http.NewRequest("POST", "/cart/"+sessionToken("couponsession"), bytes.NewBuffer(jsonpayload))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/cart/"+sessionToken("couponsession")+"/coupons", bytes.NewBuffer([]byte(`{"code": "TENTEST"}`)))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/cart/"+sessionToken("couponsession")+"/coupons", bytes.NewBuffer([]byte(`{"code": "doesnotexist"}`)))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 422, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/cart/"+sessionToken("couponsession"), nil)
+	router.ServeHTTP(w, req)
+	var cart Cart
+	_ = json.Unmarshal(w.Body.Bytes(), &cart)
+	assert.Equal(t, []Discount{{Code: "TENTEST", Type: couponPercentage, Amount: 300}}, cart.Discounts)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/cart/"+sessionToken("couponsession"), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	// Emptying the cart gave back the use of the coupon
+	uses, _ := rclient.Get(couponUsesKey("TENTEST")).Int()
+	assert.Equal(t, 0, uses)
+
+	// And merging two carts with the same coupon leaves a single use
+	for _, path := range []string{"/cart/" + sessionToken("couponmerge"), "/cart/" + userToken("couponmerge")} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", path+"/coupons", bytes.NewBuffer([]byte(`{"code": "TENTEST"}`)))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 201, w.Code)
+	}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/cart/"+sessionToken("couponmerge")+"/merge?into="+userToken("couponmerge"), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	uses, _ = rclient.Get(couponUsesKey("TENTEST")).Int()
+	assert.Equal(t, 1, uses)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/cart/"+userToken("couponmerge"), nil)
+	router.ServeHTTP(w, req)
+	uses, _ = rclient.Get(couponUsesKey("TENTEST")).Int()
+	assert.Equal(t, 0, uses)
+}
+
+func TestGetQuote(t *testing.T) {
+	router := setupRouter()
+
+	w := httptest.NewRecorder()
+	jsonpayload, _ := json.Marshal(Cart{Items: []Item{{Sku: "SKU1", Qty: 2}}})
+	req, _ := http.NewRequest("POST", "/cart/"+sessionToken("quotesession"), bytes.NewBuffer(jsonpayload))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/cart/"+sessionToken("quotesession")+"/quote", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	var quote Quote
+	_ = json.Unmarshal(w.Body.Bytes(), &quote)
+	assert.Equal(t, "EUR", quote.Currency)
+	assert.Equal(t, 1, len(quote.Lines))
+	assert.Equal(t, quote.Lines[0].UnitPrice*2, quote.Lines[0].LineTotal)
+	assert.Equal(t, quote.Subtotal-quote.Discount, quote.Total)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/cart/"+sessionToken("quotesession"), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestShareCart(t *testing.T) {
+	router := setupRouter()
+
+	w := httptest.NewRecorder()
+	jsonpayload, _ := json.Marshal(Cart{Items: []Item{{Sku: "SKU1", Qty: 2}}})
+	req, _ := http.NewRequest("POST", "/cart/"+sessionToken("sharesession"), bytes.NewBuffer(jsonpayload))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/cart/"+sessionToken("sharesession")+"/share", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+	var share struct {
+		Token string `json:"token"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &share)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/shared-cart/"+share.Token, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	var shared SharedCart
+	_ = json.Unmarshal(w.Body.Bytes(), &shared)
+	assert.Equal(t, []Item{{Sku: "SKU1", Qty: 2}}, shared.Items)
+
+	// A tampered token is refused
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/shared-cart/"+share.Token+"x", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+
+	// Copy the shared cart into another cart
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/cart/"+sessionToken("copysession")+"/copy?token="+share.Token, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/cart/"+sessionToken("copysession"), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "{\"items\":[{\"sku\":\"SKU1\",\"qty\":2}]}\n", w.Body.String())
+
+	for _, session := range []string{"sharesession", "copysession"} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("DELETE", "/cart/"+sessionToken(session), nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+	}
+}
+
+func TestCartEvents(t *testing.T) {
+	router := setupRouter()
+
+	pubsub := rclient.Subscribe(eventsChannel(cartKey(sessionID("eventsession"))))
+	defer pubsub.Close()
+	_, err := pubsub.Receive()
+	assert.Nil(t, err)
+
+	w := httptest.NewRecorder()
+	jsonpayload, _ := json.Marshal(Cart{Items: []Item{{Sku: "SKU1", Qty: 2}}})
+	req, _ := http.NewRequest("POST", "/cart/"+sessionToken("eventsession"), bytes.NewBuffer(jsonpayload))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+
+	// Every change to the cart is published
+	select {
+	case msg := <-pubsub.Channel():
+		var event CartEvent
+		_ = json.Unmarshal([]byte(msg.Payload), &event)
+		assert.Equal(t, 2, event.Count)
+		assert.Equal(t, etag(event.Version), w.Header().Get("ETag"))
+	case <-time.After(time.Second):
+		t.Error("no cart event was published")
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/cart/"+sessionToken("eventsession"), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestInvalidSession(t *testing.T) {
+	router := setupRouter()
+
+	for path, code := range map[string]int{
+		"/cart/sessiontest":                                             400,
+		"/cart/" + sessionID("sessiontest"):                             400,
+		"/cart/coupon:TENTEST." + sign(sessionSecret, "coupon:TENTEST"): 400,
+		"/cart/" + sessionID("sessiontest") + ".forged":                 401,
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", path, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, code, w.Code, path)
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	id := sessionID("migratesession")
+	rclient.Del(prefixMigrationKey)
+	rclient.HSet(id, "SKU1", 1)
+	rclient.Set(versionKey(id), 4, 0)
+	rclient.HSet(listKey(id, listSaved), "SKU2", 1)
+	rclient.Set("somebody:else", 1, 0)
+
+	assert.Nil(t, migrateKeys())
+	assert.Equal(t, int64(0), rclient.Exists(id).Val())
+	assert.Equal(t, "1", rclient.HGet(cartKey(id), "SKU1").Val())
+	assert.Equal(t, "4", rclient.Get(versionKey(cartKey(id))).Val())
+	assert.Equal(t, "1", rclient.HGet(listKey(cartKey(id), listSaved), "SKU2").Val())
+
+	// Keys that never belonged to a cart stay where they are
+	assert.Equal(t, int64(1), rclient.Exists("somebody:else").Val())
+
+	rclient.Del(cartKey(id), versionKey(cartKey(id)), listKey(cartKey(id), listSaved), "somebody:else")
+}
+
+func TestLockCart(t *testing.T) {
+	router := setupRouter()
+	path := "/cart/" + sessionToken("locksession")
+
+	w := httptest.NewRecorder()
+	jsonpayload, _ := json.Marshal(Cart{Items: []Item{{Sku: "SKU1", Qty: 1}}})
+	req, _ := http.NewRequest("POST", path, bytes.NewBuffer(jsonpayload))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", path+"/lock", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+	var snapshot Snapshot
+	_ = json.Unmarshal(w.Body.Bytes(), &snapshot)
+	assert.Equal(t, []Item{{Sku: "SKU1", Qty: 1}}, snapshot.Items)
+
+	// The cart cannot change or be locked again while it is locked
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", path, bytes.NewBuffer(jsonpayload))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 423, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", path+"/lock", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 423, w.Code)
+
+	// The snapshot can be priced
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", path+"/quote?snapshot="+snapshot.ID, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	var quote Quote
+	_ = json.Unmarshal(w.Body.Bytes(), &quote)
+	assert.Equal(t, 1, quote.Lines[0].Qty)
+
+	// Only the holder of the lock can release it
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", path+"/lock?snapshot=other", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 409, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", path+"/lock?snapshot="+snapshot.ID, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	// A checkout that went through empties the cart when it releases the lock, which gives back its coupon
+	coupon, _ := json.Marshal(Coupon{Code: "LOCKTEST", Type: couponFreeShipping})
+	rclient.Set(couponKey("LOCKTEST"), coupon, 0)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", path+"/coupons", bytes.NewBuffer([]byte(`{"code": "LOCKTEST"}`)))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+	uses, _ := rclient.Get(couponUsesKey("LOCKTEST")).Int()
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", path+"/lock", nil)
+	router.ServeHTTP(w, req)
+	_ = json.Unmarshal(w.Body.Bytes(), &snapshot)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", path+"/lock?clear=true&snapshot="+snapshot.ID, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", path, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "{\"items\":null}\n", w.Body.String())
+	left, _ := rclient.Get(couponUsesKey("LOCKTEST")).Int()
+	assert.Equal(t, uses-1, left)
+}
+
+func TestDumpAndRestoreCart(t *testing.T) {
+	router := setupRouter()
+	path := "/cart/" + sessionToken("restoresession")
+	key := cartKey(sessionID("restoresession"))
+
+	w := httptest.NewRecorder()
+	jsonpayload, _ := json.Marshal(Cart{Items: []Item{{Sku: "SKU1", Qty: 2}}})
+	req, _ := http.NewRequest("POST", path, bytes.NewBuffer(jsonpayload))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+
+	w = httptest.NewRecorder()
+	jsonpayload, _ = json.Marshal(Cart{Items: []Item{{Sku: "SKU2", Qty: 1}}})
+	req, _ = http.NewRequest("POST", path+"/lists/wishlist", bytes.NewBuffer(jsonpayload))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 201, w.Code)
+
+	state, err := dumpCart(key)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), state.Version)
+
+	// Redis loses the cart
+	rclient.Del(append(hashKeys(key), couponsKey(key), versionKey(key))...)
+	restored, err := restoreCart(key, state)
+	assert.Nil(t, err)
+	assert.True(t, restored)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", path+"/lists/wishlist", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "{\"items\":[{\"sku\":\"SKU2\",\"qty\":1}]}\n", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", path, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "{\"items\":[{\"sku\":\"SKU1\",\"qty\":2}]}\n", w.Body.String())
+	assert.Equal(t, etag(2), w.Header().Get("ETag"))
+
+	// A cart Redis still has is never overwritten
+	restored, err = restoreCart(key, cartState{})
+	assert.Nil(t, err)
+	assert.False(t, restored)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", path+"/lists/wishlist/SKU2", nil)
+	router.ServeHTTP(w, req)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", path, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestLookupAll(t *testing.T) {
+	products, err := catalog.lookupAll([]string{"SKU1", "SKU2", "doesnotexist", "SKU1", ""})
+
+	// Every existing product is found once, the rest is left out
+	assert.Nil(t, err)
+	assert.Len(t, products, 2)
+	assert.Equal(t, "SKU2", products["SKU2"].SKU)
+}
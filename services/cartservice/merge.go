@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// Conflict strategies used when both carts contain the same SKU.
+const (
+	mergeSum    = "sum"
+	mergeMax    = "max"
+	mergeLatest = "latest"
+)
+
+// mergeScript merges one cart into another inside Redis, so the merge is atomic.
+// KEYS: the source and target version, the source and target coupons, the source and target lock, followed by
+// groups of four keys for the cart and every list: source items, source timestamps, target items and target timestamps.
+// The first group is the active cart. The uses keys of the coupons applied to the source cart come last.
+// ARGV: the conflict strategy, the expected version of the source cart, which may be empty, the most of a
+// single SKU and of all items the active cart may contain, the number of coupons and their codes.
+// Returns the number of items that were merged, -1 if the source version did not match, -2 if either cart is
+// locked, -3 if the merged carts would hold more than they may or -4 if the source cart has coupons that were
+// not passed. Nothing is merged unless everything can be.
+// A coupon applied to both carts gives back one use.
+var mergeScript = redis.NewScript(`
+if ARGV[2] ~= '' and (redis.call('GET', KEYS[1]) or '0') ~= ARGV[2] then
+	return -1
+end
+if redis.call('EXISTS', KEYS[5], KEYS[6]) > 0 then
+	return -2
+end
+
+local coupons = tonumber(ARGV[5])
+local last = #KEYS - coupons
+local uses = {}
+for i = 1, coupons do
+	uses[ARGV[5 + i]] = KEYS[last + i]
+end
+for _, code in ipairs(redis.call('SMEMBERS', KEYS[3])) do
+	if not uses[code] then
+		return -4
+	end
+end
+
+local maxPerSku = tonumber(ARGV[3])
+local maxPerCart = tonumber(ARGV[4])
+local merges = {}
+for k = 7, last, 4 do
+	local merge = {}
+	local src = redis.call('HGETALL', KEYS[k])
+	for i = 1, #src, 2 do
+		local sku = src[i]
+		local qty = tonumber(src[i + 1])
+		local srcTs = tonumber(redis.call('HGET', KEYS[k + 1], sku) or '0')
+		local dstQty = redis.call('HGET', KEYS[k + 2], sku)
+		local dstTs = tonumber(redis.call('HGET', KEYS[k + 3], sku) or '0')
+
+		if dstQty then
+			dstQty = tonumber(dstQty)
+			if ARGV[1] == 'sum' then
+				qty = qty + dstQty
+			elseif ARGV[1] == 'max' then
+				qty = math.max(qty, dstQty)
+			elseif ARGV[1] == 'latest' and dstTs > srcTs then
+				qty = dstQty
+			end
+		end
+		if qty > maxPerSku then
+			return -3
+		end
+		merge[#merge + 1] = {sku, qty, math.max(srcTs, dstTs)}
+	end
+
+	-- Only the active cart is limited in size
+	if k == 7 then
+		local quantities = {}
+		local dst = redis.call('HGETALL', KEYS[k + 2])
+		for i = 1, #dst, 2 do
+			quantities[dst[i]] = tonumber(dst[i + 1])
+		end
+		for _, m in ipairs(merge) do
+			quantities[m[1]] = m[2]
+		end
+		local total = 0
+		for _, qty in pairs(quantities) do
+			total = total + qty
+		end
+		if total > maxPerCart then
+			return -3
+		end
+	end
+	merges[k] = merge
+end
+
+-- A coupon applied to both carts ends up applied once, so one of its uses is given back
+for _, code in ipairs(redis.call('SMEMBERS', KEYS[3])) do
+	if redis.call('SADD', KEYS[4], code) == 0 then
+		redis.call('DECR', uses[code])
+	end
+end
+redis.call('DEL', KEYS[3])
+
+local merged = 0
+for k = 7, last, 4 do
+	for _, m in ipairs(merges[k]) do
+		redis.call('HSET', KEYS[k + 2], m[1], m[2])
+		redis.call('HSET', KEYS[k + 3], m[1], m[3])
+	end
+	merged = merged + #merges[k]
+	redis.call('DEL', KEYS[k], KEYS[k + 1])
+end
+redis.call('INCR', KEYS[1])
+redis.call('INCR', KEYS[2])
+return merged
+`)
+
+// runMergeScript runs mergeScript to merge the cart stored under sessionid into the one stored under into,
+// with the uses keys of the coupons the source cart has right now.
+func runMergeScript(sessionid, into, strategy, expected string) (int, error) {
+	codes, err := rclient.SMembers(couponsKey(sessionid)).Result()
+	if err != nil {
+		return 0, err
+	}
+	keys := []string{
+		versionKey(sessionid), versionKey(into),
+		couponsKey(sessionid), couponsKey(into),
+		lockKey(sessionid), lockKey(into),
+		sessionid, updatedKey(sessionid), into, updatedKey(into),
+	}
+	for _, l := range lists {
+		src, dst := listKey(sessionid, l), listKey(into, l)
+		keys = append(keys, src, updatedKey(src), dst, updatedKey(dst))
+	}
+	args := []interface{}{strategy, expected, maxQtyPerSku, maxQtyPerCart, len(codes)}
+	for _, code := range codes {
+		keys = append(keys, couponUsesKey(code))
+		args = append(args, code)
+	}
+	return mergeScript.Run(rclient, keys, args...).Int()
+}
+
+// mergeCart merges an anonymous shopping cart and its lists into those of a user and deletes the anonymous cart.
+// The target cart is passed as ?into= with the session token of a user:<id> session, and ?strategy= decides
+// what happens when both carts contain the same SKU: sum the quantities (default), keep the highest quantity
+// or keep the most recently updated one.
+func mergeCart(c *gin.Context) {
+
+	// Get the session ID and the user cart to merge into
+	sessionid := cartKeyOf(c)
+	id, err := parseSession(c.Query("into"))
+	if err == errInvalidSession {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil || !strings.HasPrefix(id, "user:") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "into must be the session of a user cart in the form user:<id>",
+		})
+		return
+	}
+	into := cartKey(id)
+	if err := ensureCart(into); err != nil {
+		abortWithUpdateError(c, into, err)
+		return
+	}
+	if into == sessionid {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "cannot merge a cart into itself",
+		})
+		return
+	}
+
+	// Check the conflict strategy
+	strategy := c.DefaultQuery("strategy", mergeSum)
+	if strategy != mergeSum && strategy != mergeMax && strategy != mergeLatest {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "strategy must be one of sum, max or latest",
+		})
+		return
+	}
+
+	// Resolve an If-Match header to the exact version the script should expect
+	var expected string
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" {
+		version, err := rclient.Get(versionKey(sessionid)).Int64()
+		if err != nil && err != redis.Nil {
+			abortWithUpdateError(c, sessionid, err)
+			return
+		}
+		if !etagMatches(ifMatch, version) {
+			abortWithUpdateError(c, sessionid, errVersionMismatch)
+			return
+		}
+		expected = strconv.FormatInt(version, 10)
+	}
+
+	// Merge the carts and their lists in Redis. A coupon applied to the source cart in the meantime is retried.
+	var merged int
+	for attempt := 0; attempt < 3; attempt++ {
+		merged, err = runMergeScript(sessionid, into, strategy, expected)
+		if err != nil || merged != -4 {
+			break
+		}
+	}
+	if err == nil && merged == -4 {
+		err = errCartBusy
+	}
+	if err == nil && merged == -1 {
+		err = errVersionMismatch
+	} else if err == nil && merged == -2 {
+		err = errCartLocked
+	} else if err == nil && merged == -3 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": "invalid merge",
+			"fields": []FieldError{{"items", fmt.Sprintf(
+				"the merged cart may contain at most %v of an item and %v items", maxQtyPerSku, maxQtyPerCart)}},
+		})
+		return
+	}
+	if err == errVersionMismatch || err == errCartLocked || err == errCartBusy {
+		abortWithUpdateError(c, sessionid, err)
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sessionid": sessionid,
+			"into":      into,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Both carts changed
+	cartChanged(sessionid)
+	cartChanged(into)
+
+	// Return the merged cart
+	cart, version, err := loadCart(into)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"into": into,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	log.WithFields(log.Fields{
+		"sessionid": sessionid,
+		"into":      into,
+		"strategy":  strategy,
+		"items":     merged,
+	}).Info("Merged cart")
+	c.Header("ETag", etag(version))
+	c.JSON(
+		http.StatusOK,
+		cart,
+	)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// prefixMigrationKey is set once all cart data has been moved under keyPrefix
+const prefixMigrationKey = "migration:cart-prefix"
+
+// legacyKeyPattern matches the keys cart data was stored under before keys were namespaced: a cart, its lists
+// and the timestamps, versions and coupons of each, and the snapshots of shared carts.
+var legacyKeyPattern = regexp.MustCompile(`^(([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}|user:[A-Za-z0-9_-]{1,64})` +
+	`(:list:(saved|wishlist))?(:(updated|version|coupons))?|shared:[0-9a-f]{32})$`)
+
+// migrateKeys moves cart data stored before keys were namespaced under keyPrefix.
+// Only keys in the shape of legacyKeyPattern are renamed, anything else in the database is left alone.
+// The migration only runs once, and is safe to run from several instances at the same time.
+func migrateKeys() error {
+	done, err := rclient.Exists(prefixMigrationKey).Result()
+	if err != nil || done == 1 {
+		return err
+	}
+
+	var cursor uint64
+	moved := 0
+	for {
+		keys, next, err := rclient.Scan(cursor, "*", 100).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if !legacyKeyPattern.MatchString(key) {
+				continue
+			}
+
+			// Another instance may have moved the key already, and a cart that was written under
+			// the new key in the meantime is newer than the old one.
+			ok, err := rclient.RenameNX(key, keyPrefix+key).Result()
+			if err != nil && err.Error() != "ERR no such key" {
+				return err
+			}
+			if ok {
+				moved++
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	log.Printf("Moved %v keys under the prefix '%v'", moved, keyPrefix)
+	return rclient.Set(prefixMigrationKey, time.Now().Unix(), 0).Err()
+}
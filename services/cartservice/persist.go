@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres" // Postgres driver
+	log "github.com/sirupsen/logrus"
+)
+
+// persistInterval is how often changed carts are written to Postgres
+const persistInterval = time.Second
+
+// missTTL is how long we remember that Postgres has no copy of a cart, so new visitors do not cost a query
+// on every request
+const missTTL = time.Hour
+
+// missKey returns the Redis key that is set while Postgres is known to have no copy of the cart stored under key.
+func missKey(key string) string {
+	return key + ":nostored"
+}
+
+// StoredCart is the durable copy of a cart, its lists and coupons
+type StoredCart struct {
+	CartKey   string `gorm:"primary_key"`
+	Data      string `gorm:"type:text"`
+	Version   int64
+	UpdatedAt time.Time
+}
+
+// cartState holds everything Redis knows about a cart.
+// Hashes are keyed by the suffix of their Redis key, e.g. "" for the items and ":list:saved" for a list.
+type cartState struct {
+	Hashes  map[string]map[string]string `json:"hashes"`
+	Coupons []string                     `json:"coupons"`
+	Version int64                        `json:"version"`
+}
+
+// cartStore writes carts behind to Postgres, so they survive losing Redis.
+// Changed carts are collected and written in the background, which keeps Postgres out of the request path.
+// The last changes before a crash of cartservice itself can be lost, but they are still in Redis.
+type cartStore struct {
+	db      *gorm.DB
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+// store is nil when persistence is disabled
+var store *cartStore
+
+// hashKeys returns the Redis keys of all hashes belonging to the cart stored under key.
+func hashKeys(key string) []string {
+	keys := []string{key, updatedKey(key)}
+	for _, l := range lists {
+		keys = append(keys, listKey(key, l), updatedKey(listKey(key, l)))
+	}
+	return keys
+}
+
+// dumpCart reads the full state of the cart stored under key from Redis.
+func dumpCart(key string) (cartState, error) {
+	keys := hashKeys(key)
+	hashes := make([]*redis.StringStringMapCmd, len(keys))
+	var coupons *redis.StringSliceCmd
+	var version *redis.StringCmd
+	_, err := rclient.TxPipelined(func(pipe redis.Pipeliner) error {
+		for n, k := range keys {
+			hashes[n] = pipe.HGetAll(k)
+		}
+		coupons = pipe.SMembers(couponsKey(key))
+		version = pipe.Get(versionKey(key))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return cartState{}, err
+	}
+
+	state := cartState{Hashes: make(map[string]map[string]string), Coupons: coupons.Val()}
+	for n, k := range keys {
+		if h := hashes[n].Val(); len(h) > 0 {
+			state.Hashes[strings.TrimPrefix(k, key)] = h
+		}
+	}
+	state.Version, err = version.Int64()
+	if err == redis.Nil {
+		err = nil
+	}
+	return state, err
+}
+
+// restoreCart writes the state of a cart back to Redis, unless Redis already has the cart.
+// Returns whether the cart was restored.
+func restoreCart(key string, state cartState) (bool, error) {
+	restored := false
+	err := rclient.Watch(func(tx *redis.Tx) error {
+		exists, err := tx.Exists(versionKey(key)).Result()
+		if err != nil || exists > 0 {
+			return err
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			for suffix, h := range state.Hashes {
+				fields := make(map[string]interface{}, len(h))
+				for f, v := range h {
+					fields[f] = v
+				}
+				pipe.HMSet(key+suffix, fields)
+			}
+			for _, code := range state.Coupons {
+				pipe.SAdd(couponsKey(key), code)
+			}
+			pipe.Set(versionKey(key), state.Version, 0)
+			return nil
+		})
+		restored = err == nil
+		return err
+	}, versionKey(key))
+	if err == redis.TxFailedErr {
+		// The cart was written in the meantime, which is newer than our copy
+		return false, nil
+	}
+	return restored, err
+}
+
+// newCartStore connects to Postgres and creates the table carts are stored in.
+func newCartStore(dbURI string) (*cartStore, error) {
+	db, err := gorm.Open("postgres", dbURI)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(&StoredCart{}).Error; err != nil {
+		return nil, err
+	}
+	return &cartStore{db: db, pending: make(map[string]bool)}, nil
+}
+
+// markDirty queues the cart stored under key to be written to Postgres.
+func (s *cartStore) markDirty(key string) {
+	s.mu.Lock()
+	s.pending[key] = true
+	s.mu.Unlock()
+}
+
+// run writes the queued carts to Postgres every interval. It never returns.
+func (s *cartStore) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.flush()
+	}
+}
+
+// flush writes all queued carts to Postgres. Carts that could not be written stay queued.
+func (s *cartStore) flush() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[string]bool)
+	s.mu.Unlock()
+
+	for key := range pending {
+		if err := s.save(key); err != nil {
+			log.WithFields(log.Fields{
+				"sessionid": key,
+			}).Error(err)
+			s.markDirty(key)
+		}
+	}
+}
+
+// save writes the current state of the cart stored under key to Postgres.
+func (s *cartStore) save(key string) error {
+	state, err := dumpCart(key)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return s.db.Save(&StoredCart{CartKey: key, Data: string(data), Version: state.Version}).Error
+}
+
+// restore copies the cart stored under key from Postgres to Redis, if Redis does not have it.
+func (s *cartStore) restore(stored StoredCart) (bool, error) {
+	var state cartState
+	if err := json.Unmarshal([]byte(stored.Data), &state); err != nil {
+		return false, err
+	}
+	return restoreCart(stored.CartKey, state)
+}
+
+// ensure rehydrates the cart stored under key from Postgres when Redis does not know it.
+// A cart Postgres does not have either is remembered for a while. Only carts that were in Redis are ever
+// written to Postgres, so until the cart shows up in Redis there is nothing to restore.
+func (s *cartStore) ensure(key string) error {
+	exists, err := rclient.Exists(versionKey(key), missKey(key)).Result()
+	if err != nil || exists > 0 {
+		return err
+	}
+
+	var stored StoredCart
+	if err := s.db.Where("cart_key = ?", key).First(&stored).Error; gorm.IsRecordNotFoundError(err) {
+		return rclient.Set(missKey(key), 1, missTTL).Err()
+	} else if err != nil {
+		return err
+	}
+	restored, err := s.restore(stored)
+	if restored {
+		log.WithFields(log.Fields{
+			"sessionid": key,
+		}).Info("Restored cart from Postgres")
+	}
+	return err
+}
+
+// ensureCart makes sure a cart that was lost from Redis is restored before it is used.
+func ensureCart(key string) error {
+	if store == nil {
+		return nil
+	}
+	return store.ensure(key)
+}
+
+// rehydrate copies every stored cart that is missing from Redis back into it, e.g. after Redis was flushed.
+func (s *cartStore) rehydrate() error {
+	const batchSize = 500
+	restored := 0
+	for offset := 0; ; offset += batchSize {
+		var batch []StoredCart
+		if err := s.db.Order("cart_key").Offset(offset).Limit(batchSize).Find(&batch).Error; err != nil {
+			return err
+		}
+		for _, stored := range batch {
+			ok, err := s.restore(stored)
+			if err != nil {
+				return err
+			}
+			if ok {
+				restored++
+			}
+		}
+		if len(batch) < batchSize {
+			break
+		}
+	}
+	log.Printf("Restored %v carts from Postgres", restored)
+	return nil
+}
+
+// setupStore enables persistence to Postgres when DB_HOST is set, and rehydrates Redis in the background.
+func setupStore() {
+	dbHost := os.Getenv("DB_HOST")
+	if dbHost == "" {
+		log.Println("DB_HOST not set, carts are only kept in Redis")
+		return
+	}
+	dbName := os.Getenv("DB_NAME")
+	if dbName == "" {
+		dbName = "carts"
+	}
+	dbURI := fmt.Sprintf("host=%s user=%s dbname=%s sslmode=disable password=%s", dbHost, "postgres", dbName, os.Getenv("DB_PASS"))
+
+	log.Printf("Connecting to database on host '%v'...", dbHost)
+	var err error
+	for counter := 3; counter > 0; counter-- {
+		store, err = newCartStore(dbURI)
+		if err == nil {
+			break
+		}
+		log.Printf("Could not connect to database on host '%v', trying %v more time(s)", dbHost, counter)
+		time.Sleep(2 * time.Second)
+	}
+	if err != nil {
+		log.Panicf("Could not connect to database on host '%v'.", dbHost)
+	}
+	log.Printf("Successfully connected to database on host '%v'...", dbHost)
+
+	go func() {
+		if err := store.rehydrate(); err != nil {
+			log.Errorf("Could not restore carts from Postgres: %v", err)
+		}
+	}()
+	go store.run(persistInterval)
+}
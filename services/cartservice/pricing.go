@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// currency is the currency of all prices in the catalog
+const currency = "EUR"
+
+// Quote is a fully priced shopping cart. All amounts are in cents, as listed in the catalog. The VAT depends on
+// the country the cart is shipped to, which the checkoutservice works out.
+type Quote struct {
+	Currency     string      `json:"currency"`
+	Lines        []QuoteLine `json:"lines"`
+	Subtotal     int         `json:"subtotal"`
+	Discounts    []Discount  `json:"discounts"`
+	Discount     int         `json:"discount"`
+	FreeShipping bool        `json:"free_shipping"`
+	Total        int         `json:"total"`
+}
+
+// QuoteLine is a single priced item in a Quote
+type QuoteLine struct {
+	Sku         string `json:"sku"`
+	Name        string `json:"name"`
+	Qty         int    `json:"qty"`
+	UnitPrice   int    `json:"unit_price"`
+	LineTotal   int    `json:"line_total"`
+	TaxClass    string `json:"tax_class,omitempty"`
+	Weight      int    `json:"weight,omitempty"`
+	Unavailable bool   `json:"unavailable,omitempty"`
+}
+
+// priceCart prices the cart stored under key, including the coupons applied to it.
+func priceCart(key string, cart Cart) (Quote, error) {
+	coupons, err := cartCoupons(key)
+	if err != nil {
+		return Quote{}, err
+	}
+	return priceItems(cart, coupons)
+}
+
+// priceItems prices a cart with the given coupons. This is the one place where cart totals are calculated,
+// so every page and service that shows or charges a total uses the same numbers.
+func priceItems(cart Cart, coupons []Coupon) (Quote, error) {
+	quote := Quote{
+		Currency:  currency,
+		Lines:     []QuoteLine{},
+		Discounts: []Discount{},
+	}
+
+	// Price every item
+	products, err := catalog.lookupAll(skus(cart.Items))
+	if err != nil {
+		return Quote{}, err
+	}
+	prices := make(map[string]int)
+	for _, i := range cart.Items {
+		line := QuoteLine{Sku: i.Sku, Qty: i.Qty}
+		product, ok := products[i.Sku]
+		if !ok {
+			line.Unavailable = true
+		} else {
+			line.Name = product.Name
+			line.UnitPrice = product.Price
+			line.LineTotal = product.Price * i.Qty
+			line.TaxClass = product.TaxClass
+			line.Weight = product.Weight
+			prices[i.Sku] = product.Price
+		}
+		quote.Lines = append(quote.Lines, line)
+		quote.Subtotal += line.LineTotal
+	}
+
+	// Apply the coupons
+	for _, d := range computeDiscounts(cart.Items, prices, coupons, time.Now()) {
+		quote.Discounts = append(quote.Discounts, d)
+		quote.Discount += d.Amount
+		quote.FreeShipping = quote.FreeShipping || d.FreeShipping
+	}
+
+	quote.Total = quote.Subtotal - quote.Discount
+	return quote, nil
+}
+
+// getQuote prices a shopping cart and returns the Quote as JSON.
+// With ?snapshot= the snapshot taken when the cart was locked for checkout is priced instead.
+func getQuote(c *gin.Context) {
+
+	// Get the session ID
+	sessionid := cartKeyOf(c)
+
+	// Price a snapshot if one was asked for
+	if id := c.Query("snapshot"); id != "" {
+		snapshot, err := loadSnapshot(sessionid, id)
+		if err == redis.Nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "no such snapshot",
+			})
+			return
+		} else if err != nil {
+			log.WithFields(log.Fields{
+				"sessionid": sessionid,
+			}).Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		quote, err := priceSnapshot(snapshot)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"sessionid": sessionid,
+			}).Error(err)
+			c.JSON(http.StatusBadGateway, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.Header("ETag", etag(snapshot.Version))
+		c.JSON(
+			http.StatusOK,
+			quote,
+		)
+		return
+	}
+
+	// Get all items in the shopping cart by session ID
+	cart, version, err := loadCart(sessionid)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sessionid": sessionid,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Price the cart
+	quote, err := priceCart(sessionid, cart)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sessionid": sessionid,
+		}).Error(err)
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Return the quote
+	c.Header("ETag", etag(version))
+	c.JSON(
+		http.StatusOK,
+		quote,
+	)
+}
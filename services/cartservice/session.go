@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// keyPrefix is put in front of every Redis key holding cart data
+const keyPrefix = "cart:"
+
+// cartKeyContext is the name under which requireSession stores the cart key in the request context
+const cartKeyContext = "cartkey"
+
+// sessionPattern matches the IDs a session token may carry: the UUID of an anonymous session,
+// or user:<id> for the cart of a signed in user.
+var sessionPattern = regexp.MustCompile(`^([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}|user:[A-Za-z0-9_-]{1,64})$`)
+
+// Errors returned when a session token cannot be used
+var (
+	errMalformedSession = errors.New("malformed session")
+	errInvalidSession   = errors.New("invalid session signature")
+)
+
+// cartKey returns the Redis key of the cart belonging to a session ID.
+func cartKey(id string) string {
+	return keyPrefix + id
+}
+
+// parseSession checks a session token, issued by frontendservice as <session id>.<signature>,
+// and returns the session ID.
+func parseSession(token string) (string, error) {
+	dot := strings.LastIndex(token, ".")
+	if dot < 0 || !sessionPattern.MatchString(token[:dot]) {
+		return "", errMalformedSession
+	}
+	if !verify(sessionSecret, token[:dot], token[dot+1:]) {
+		return "", errInvalidSession
+	}
+	return token[:dot], nil
+}
+
+// requireSession refuses requests that do not carry a valid session token as :sessionid,
+// and stores the key of the cart the token gives access to in the request context.
+func requireSession(c *gin.Context) {
+	id, err := parseSession(c.Param("sessionid"))
+	if err == errMalformedSession {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	key := cartKey(id)
+	if err := ensureCart(key); err != nil {
+		c.Abort()
+		abortWithUpdateError(c, key, err)
+		return
+	}
+	c.Set(cartKeyContext, key)
+}
+
+// cartKeyOf returns the key of the cart a request is about, as stored by requireSession.
+func cartKeyOf(c *gin.Context) string {
+	return c.GetString(cartKeyContext)
+}
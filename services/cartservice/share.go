@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long shared cart links stay valid
+const (
+	defaultShareTTL = 7 * 24 * time.Hour
+	maxShareTTL     = 30 * 24 * time.Hour
+)
+
+// Errors returned when a share token cannot be used
+var (
+	errInvalidShare = errors.New("invalid share link")
+	errShareExpired = errors.New("this share link has expired")
+)
+
+// SharedCart is a read-only snapshot of a shopping cart that can be sent to someone else
+type SharedCart struct {
+	Items   []Item    `json:"items"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+
+	// Quote prices the snapshot at the moment it is read
+	Quote *Quote `json:"quote,omitempty"`
+}
+
+// sharedKey returns the Redis key of a shared cart snapshot.
+func sharedKey(id string) string {
+	return keyPrefix + "shared:" + id
+}
+
+// shareToken creates the token that gives access to a shared cart snapshot until it expires.
+// Tokens look like <snapshot id>.<expiry as unix time>.<signature>.
+func shareToken(id string, expires time.Time) string {
+	payload := id + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + sign(shareSecret, payload)
+}
+
+// parseShareToken checks the signature and expiry of a share token and returns the snapshot id.
+func parseShareToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || !verify(shareSecret, parts[0]+"."+parts[1], parts[2]) {
+		return "", errInvalidShare
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", errInvalidShare
+	}
+	if time.Now().Unix() > expires {
+		return "", errShareExpired
+	}
+	return parts[0], nil
+}
+
+// loadSharedCart reads the snapshot a share token points to.
+func loadSharedCart(token string) (SharedCart, error) {
+	id, err := parseShareToken(token)
+	if err != nil {
+		return SharedCart{}, err
+	}
+	result, err := rclient.Get(sharedKey(id)).Bytes()
+	if err == redis.Nil {
+		return SharedCart{}, errShareExpired
+	} else if err != nil {
+		return SharedCart{}, err
+	}
+	var shared SharedCart
+	err = json.Unmarshal(result, &shared)
+	return shared, err
+}
+
+// abortWithShareError writes the response for an error returned by loadSharedCart.
+func abortWithShareError(c *gin.Context, token string, err error) {
+	switch err {
+	case errInvalidShare:
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+	case errShareExpired:
+		c.JSON(http.StatusGone, gin.H{
+			"error": err.Error(),
+		})
+	default:
+		log.WithFields(log.Fields{
+			"token": token,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+	}
+}
+
+// shareCart takes a snapshot of a shopping cart and returns a signed token that gives read-only access to it.
+// The link stays valid for a week, or for the duration passed as ?ttl=, e.g. ?ttl=48h.
+func shareCart(c *gin.Context) {
+
+	// Get the session ID
+	sessionid := cartKeyOf(c)
+
+	// Work out how long the link should stay valid
+	ttl := defaultShareTTL
+	if v := c.Query("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > maxShareTTL {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "ttl must be a duration of at most " + maxShareTTL.String(),
+			})
+			return
+		}
+		ttl = d
+	}
+
+	// Get all items in the shopping cart
+	cart, _, err := loadCart(sessionid)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sessionid": sessionid,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if len(cart.Items) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": "cannot share an empty cart",
+		})
+		return
+	}
+
+	// Store the snapshot for as long as the link is valid
+	id, err := randomID()
+	if err == nil {
+		now := time.Now().UTC()
+		shared := SharedCart{
+			Items:   cart.Items,
+			Created: now,
+			Expires: now.Add(ttl),
+		}
+		payload, _ := json.Marshal(shared)
+		err = rclient.Set(sharedKey(id), payload, ttl).Err()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sessionid": sessionid,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Return the token
+	expires := time.Now().Add(ttl).UTC()
+	log.WithFields(log.Fields{
+		"sessionid": sessionid,
+		"expires":   expires,
+	}).Info("Shared cart")
+	c.JSON(
+		http.StatusCreated,
+		gin.H{
+			"token":   shareToken(id, expires),
+			"expires": expires,
+		},
+	)
+}
+
+// getSharedCart returns the read-only snapshot a share token points to, priced at current prices.
+func getSharedCart(c *gin.Context) {
+
+	// Get the snapshot
+	token := c.Param("token")
+	shared, err := loadSharedCart(token)
+	if err != nil {
+		abortWithShareError(c, token, err)
+		return
+	}
+
+	// Price it
+	quote, err := priceItems(Cart{Items: shared.Items}, nil)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"token": token,
+		}).Error(err)
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	shared.Quote = &quote
+
+	// Return the data
+	c.JSON(
+		http.StatusOK,
+		shared,
+	)
+}
+
+// copySharedCart adds the items of a shared cart, passed as ?token=, to a shopping cart.
+func copySharedCart(c *gin.Context) {
+
+	// Get the session ID and the snapshot
+	sessionid := cartKeyOf(c)
+	token := c.Query("token")
+	shared, err := loadSharedCart(token)
+	if err != nil {
+		abortWithShareError(c, token, err)
+		return
+	}
+
+	// The quantities are added to what is already in the cart, which has to stay within the cart rules
+	cart, _, err := loadCart(sessionid)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sessionid": sessionid,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	combined := Cart{Items: shared.Items}
+	for n, i := range combined.Items {
+		for _, existing := range cart.Items {
+			if existing.Sku == i.Sku {
+				combined.Items[n].Qty += existing.Qty
+			}
+		}
+	}
+	fieldErrors, err := validateCart(sessionid, combined, false)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sessionid": sessionid,
+		}).Error(err)
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":  "invalid cart items",
+			"fields": fieldErrors,
+		})
+		return
+	}
+
+	// Add the items to the cart
+	now := time.Now().UnixNano()
+	version, err := updateCart(sessionid, c.GetHeader("If-Match"), func(_ *redis.Tx, pipe redis.Pipeliner) error {
+		for _, i := range shared.Items {
+			pipe.HIncrBy(sessionid, i.Sku, int64(i.Qty))
+			pipe.HSet(updatedKey(sessionid), i.Sku, now)
+		}
+		return nil
+	})
+	if err != nil {
+		abortWithUpdateError(c, sessionid, err)
+		return
+	}
+
+	// Return status created
+	log.WithFields(log.Fields{
+		"items":     shared.Items,
+		"sessionid": sessionid,
+	}).Info("Copied shared cart")
+	c.Header("ETag", etag(version))
+	c.JSON(
+		http.StatusCreated,
+		gin.H{
+			"status": "ok",
+		},
+	)
+}
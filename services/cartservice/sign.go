@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// sign returns the HMAC-SHA256 signature of value, encoded so it can be used in URLs.
+func sign(secret []byte, value string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify reports whether signature is a valid signature of value.
+func verify(secret []byte, value, signature string) bool {
+	return hmac.Equal([]byte(sign(secret, value)), []byte(signature))
+}
+
+// randomID returns a random identifier that is hard to guess.
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
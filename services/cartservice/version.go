@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// errVersionMismatch is returned when a cart was modified since the client last read it.
+var errVersionMismatch = errors.New("the cart has been modified, reload it and try again")
+
+// errCartBusy is returned when a cart kept changing while we tried to change it, without the client asking for
+// a particular version.
+var errCartBusy = errors.New("the cart is being changed by another request, try again")
+
+// errCartLocked is returned when a cart cannot be modified because it is being checked out.
+var errCartLocked = errors.New("the cart is locked while it is being checked out")
+
+// versionKey returns the Redis key of the counter that is bumped on every change to a cart.
+// The counter outlives the cart itself, so an emptied cart never reuses an old version.
+func versionKey(key string) string {
+	return key + ":version"
+}
+
+// etag formats a cart version as an HTTP entity tag.
+func etag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// etagMatches reports whether an If-Match header matches the given cart version.
+func etagMatches(ifMatch string, version int64) bool {
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// cartChanged is called after every change to the cart stored under key. It notifies everyone listening
+// and queues the cart to be written to Postgres.
+func cartChanged(key string) {
+	publishCartEvent(key)
+	if store != nil {
+		store.markDirty(key)
+	}
+}
+
+// updateCart runs fn to modify the cart stored under key in a single Redis transaction and bumps the cart version.
+// fn queues its changes on pipe, and may use tx to read the current state of the cart first.
+// When ifMatch is not empty the change is only made if it matches the version of the cart, otherwise
+// errVersionMismatch is returned. Without it the change is retried a few times when the cart changes underneath
+// it, after which errCartBusy is returned. A locked cart is never changed, errCartLocked is returned instead.
+// Everyone listening for changes to the cart is notified.
+// Returns the new version of the cart.
+func updateCart(key, ifMatch string, fn func(tx *redis.Tx, pipe redis.Pipeliner) error) (int64, error) {
+	var version int64
+	txf := func(tx *redis.Tx) error {
+		current, err := tx.Get(versionKey(key)).Int64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if ifMatch != "" && !etagMatches(ifMatch, current) {
+			return errVersionMismatch
+		}
+		locked, err := tx.Exists(lockKey(key)).Result()
+		if err != nil {
+			return err
+		}
+		if locked > 0 {
+			return errCartLocked
+		}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			if err := fn(tx, pipe); err != nil {
+				return err
+			}
+			pipe.Incr(versionKey(key))
+			pipe.Del(missKey(key))
+			return nil
+		})
+		version = current + 1
+		return err
+	}
+
+	// Somebody else changed the cart while we were at it. Without an If-Match header
+	// the client does not care, so we simply try again.
+	for attempt := 0; attempt < 3; attempt++ {
+		// Taking the lock fails any change that is in flight, so nothing slips past a snapshot
+		err := rclient.Watch(txf, versionKey(key), lockKey(key))
+		if err == redis.TxFailedErr {
+			if ifMatch != "" {
+				return 0, errVersionMismatch
+			}
+			continue
+		}
+		if err == nil {
+			cartChanged(key)
+		}
+		return version, err
+	}
+	return 0, errCartBusy
+}
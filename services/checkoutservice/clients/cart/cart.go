@@ -0,0 +1,95 @@
+// Package cart is the client of cartservice.
+package cart
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/clients/rest"
+)
+
+// ErrLocked is returned when a cart is already being checked out.
+var ErrLocked = errors.New("this cart is already being checked out")
+
+// Quote is a fully priced shopping cart, as calculated by the cartservice. All amounts are in cents.
+type Quote struct {
+	Currency string      `json:"currency"`
+	Lines    []QuoteLine `json:"lines"`
+	Subtotal int         `json:"subtotal"`
+	Discount int         `json:"discount"`
+	Total    int         `json:"total"`
+
+	// FreeShipping is set when a coupon makes standard shipping free
+	FreeShipping bool `json:"free_shipping"`
+}
+
+// QuoteLine is a single priced item in a Quote
+type QuoteLine struct {
+	Sku       string `json:"sku"`
+	Name      string `json:"name"`
+	Qty       int    `json:"qty"`
+	UnitPrice int    `json:"unit_price"`
+	LineTotal int    `json:"line_total"`
+	TaxClass  string `json:"tax_class"`
+
+	// Weight is the shipping weight of a single item in grams
+	Weight int `json:"weight"`
+
+	// Unavailable is set when the product is no longer in the catalog
+	Unavailable bool `json:"unavailable"`
+}
+
+// Client calls cartservice.
+type Client struct {
+	*rest.Client
+}
+
+// New creates a client for the cartservice at baseURL.
+func New(baseURL string) *Client {
+	return &Client{rest.New("cartservice", baseURL, 3*time.Second)}
+}
+
+// Lock locks the shopping cart for checkout. Returns the ID of the snapshot of the cart that was taken,
+// which stays the same until the cart is unlocked.
+func (c *Client) Lock(ctx context.Context, sessionid string) (string, error) {
+	var snapshot struct {
+		ID string `json:"id"`
+	}
+	err := c.Do(ctx, rest.Request{
+		Method: http.MethodPost,
+		Path:   "/cart/" + url.PathEscape(sessionid) + "/lock",
+	}, &snapshot)
+	if rest.StatusCode(err) == http.StatusLocked {
+		return "", ErrLocked
+	}
+	return snapshot.ID, err
+}
+
+// Unlock releases the checkout lock on the shopping cart.
+func (c *Client) Unlock(ctx context.Context, sessionid, snapshot string) error {
+	return c.Do(ctx, rest.Request{
+		Method: http.MethodDelete,
+		Path:   "/cart/" + url.PathEscape(sessionid) + "/lock?snapshot=" + url.QueryEscape(snapshot),
+	}, nil)
+}
+
+// Clear releases the checkout lock on the shopping cart and empties it, once it has been checked out.
+func (c *Client) Clear(ctx context.Context, sessionid, snapshot string) error {
+	return c.Do(ctx, rest.Request{
+		Method: http.MethodDelete,
+		Path:   "/cart/" + url.PathEscape(sessionid) + "/lock?clear=true&snapshot=" + url.QueryEscape(snapshot),
+	}, nil)
+}
+
+// Quote returns the priced snapshot of a locked shopping cart, which may have no lines.
+func (c *Client) Quote(ctx context.Context, sessionid, snapshot string) (Quote, error) {
+	var quote Quote
+	err := c.Do(ctx, rest.Request{
+		Method: http.MethodGet,
+		Path:   "/cart/" + url.PathEscape(sessionid) + "/quote?snapshot=" + url.QueryEscape(snapshot),
+	}, &quote)
+	return quote, err
+}
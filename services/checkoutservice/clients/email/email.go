@@ -0,0 +1,36 @@
+// Package email is the client of emailservice.
+package email
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/clients/rest"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/mail"
+)
+
+// Client calls emailservice. It is a mail.Transport.
+type Client struct {
+	*rest.Client
+}
+
+// New creates a client for the emailservice at baseURL.
+func New(baseURL string) *Client {
+	return &Client{rest.New("emailservice", baseURL, 5*time.Second)}
+}
+
+// Send has emailservice deliver a message. It is never retried, so the user never gets it twice.
+func (c *Client) Send(ctx context.Context, m mail.Message) error {
+	return c.Do(ctx, rest.Request{
+		Method: http.MethodPost,
+		Path:   "/email",
+		Body: map[string]string{
+			"email":   m.To,
+			"from":    m.From,
+			"subject": m.Subject,
+			"text":    m.Text,
+			"html":    m.HTML,
+		},
+	}, nil)
+}
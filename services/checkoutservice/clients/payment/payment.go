@@ -0,0 +1,89 @@
+// Package payment is the client of paymentservice.
+package payment
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/clients/rest"
+)
+
+// ErrDeclined is returned when the card was declined.
+var ErrDeclined = errors.New("the payment was declined")
+
+// ErrInvalidCard is returned when the card token is unknown or has expired.
+var ErrInvalidCard = errors.New("the card token is unknown or has expired")
+
+// Client calls paymentservice.
+type Client struct {
+	*rest.Client
+}
+
+// New creates a client for the paymentservice at baseURL.
+func New(baseURL string) *Client {
+	return &Client{rest.New("paymentservice", baseURL, 10*time.Second)}
+}
+
+// Charge charges the card that was tokenized as token. The reference identifies the charge for a refund in case
+// we never learn the transaction id. A charge is never retried, as paymentservice would charge the card again.
+// Returns the transaction id.
+func (c *Client) Charge(ctx context.Context, token string, amount int, reference string) (string, error) {
+	var resp struct {
+		TransactionID string `json:"transactionid"`
+	}
+	err := c.Do(ctx, rest.Request{
+		Method: http.MethodPost,
+		Path:   "/payment",
+		Body: map[string]interface{}{
+			"token":     token,
+			"amount":    amount,
+			"reference": reference,
+		},
+	}, &resp)
+	switch rest.StatusCode(err) {
+	case http.StatusPaymentRequired:
+		return "", ErrDeclined
+	case http.StatusBadRequest:
+		return "", ErrInvalidCard
+	}
+	return resp.TransactionID, err
+}
+
+// Refund refunds a charge, identified by its transaction id or the reference it was made with.
+// A charge that never happened needs no refund.
+func (c *Client) Refund(ctx context.Context, transactionid, reference string) error {
+	err := c.Do(ctx, rest.Request{
+		Method: http.MethodPost,
+		Path:   "/refund",
+		Body: map[string]string{
+			"transactionid": transactionid,
+			"reference":     reference,
+		},
+		Idempotent: true,
+	}, nil)
+	if rest.StatusCode(err) == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// RefundAmount refunds part of a charge, identified by its transaction id. The reference identifies the refund,
+// so retrying it never refunds twice. Returns the refund id.
+func (c *Client) RefundAmount(ctx context.Context, transactionid string, amount int, reference string) (string, error) {
+	var resp struct {
+		RefundID string `json:"refundid"`
+	}
+	err := c.Do(ctx, rest.Request{
+		Method: http.MethodPost,
+		Path:   "/refund",
+		Body: map[string]interface{}{
+			"transactionid": transactionid,
+			"amount":        amount,
+			"reference":     reference,
+		},
+		Idempotent: true,
+	}, &resp)
+	return resp.RefundID, err
+}
@@ -0,0 +1,63 @@
+package rest
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling a service when too many calls to it failed in a row.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// Breaker is a circuit breaker. After threshold failures in a row it opens and rejects every call for
+// the cooldown period. After that a single trial call is let through, which closes the breaker again
+// when it succeeds and reopens it when it fails.
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	trial     bool
+}
+
+// NewBreaker creates a closed circuit breaker.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow returns ErrCircuitOpen if a call must not be made right now.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	if b.trial || time.Since(b.openedAt) < b.cooldown {
+		return ErrCircuitOpen
+	}
+	b.trial = true
+	return nil
+}
+
+// Success records a call that succeeded.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.trial = false
+}
+
+// Failure records a call that failed.
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.trial = false
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
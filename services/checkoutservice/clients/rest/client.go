@@ -0,0 +1,201 @@
+// Package rest is the HTTP client shared by the clients of the services checkoutservice calls. It encodes and
+// decodes JSON, gives every attempt its own timeout, retries idempotent requests with jittered exponential
+// backoff and stops calling a service that keeps failing.
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Error is returned when a call to a service fails.
+type Error struct {
+	Service string
+
+	// StatusCode is the status code outside of the 2xx range the service answered with, or 0 if it did not answer
+	StatusCode int
+	Message    string
+
+	// Err is the reason the service did not answer
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%v: %v", e.Service, e.Err)
+	}
+	if e.Message == "" {
+		return fmt.Sprintf("%v returned %v", e.Service, e.StatusCode)
+	}
+	return fmt.Sprintf("%v returned %v: %v", e.Service, e.StatusCode, e.Message)
+}
+
+// StatusCode returns the status code a service answered with, or 0 if err did not come from the service.
+func StatusCode(err error) int {
+	if e, ok := err.(*Error); ok {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// Timeout reports whether err is a call to a service that did not answer in time.
+func Timeout(err error) bool {
+	e, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+	if e.Err == context.DeadlineExceeded {
+		return true
+	}
+	netErr, ok := e.Err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// CircuitOpen reports whether err is a call that was not made because the service kept failing.
+func CircuitOpen(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Err == ErrCircuitOpen
+}
+
+// Request is a single call to a service.
+type Request struct {
+	Method string
+	Path   string
+	Body   interface{}
+
+	// Idempotent requests are retried when they fail in a way that may be temporary. GET and DELETE
+	// requests always are.
+	Idempotent bool
+}
+
+// Client calls a single service.
+type Client struct {
+	Service    string
+	BaseURL    string
+	HTTPClient *http.Client
+
+	// Timeout limits every attempt of a call
+	Timeout time.Duration
+
+	// Attempts is the number of times an idempotent request is tried, Backoff the wait before the first retry.
+	// The wait doubles for every retry and a random part of it is used, so clients do not retry in lockstep.
+	Attempts int
+	Backoff  time.Duration
+
+	Breaker *Breaker
+}
+
+// New creates a client for the service at baseURL, which retries three times and opens its circuit breaker
+// for 30 seconds after 5 failures in a row.
+func New(service, baseURL string, timeout time.Duration) *Client {
+	return &Client{
+		Service:    service,
+		BaseURL:    baseURL,
+		HTTPClient: &http.Client{},
+		Timeout:    timeout,
+		Attempts:   3,
+		Backoff:    100 * time.Millisecond,
+		Breaker:    NewBreaker(5, 30*time.Second),
+	}
+}
+
+// Do makes the request and decodes the JSON response into out, unless out is nil.
+func (c *Client) Do(ctx context.Context, req Request, out interface{}) error {
+	var payload []byte
+	if req.Body != nil {
+		var err error
+		if payload, err = json.Marshal(req.Body); err != nil {
+			return err
+		}
+	}
+
+	attempts := 1
+	if req.Idempotent || req.Method == http.MethodGet || req.Method == http.MethodDelete {
+		attempts = c.Attempts
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			wait := c.Backoff << uint(attempt-1)
+			if wait > 0 {
+				wait = time.Duration(rand.Int63n(int64(wait)))
+			}
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return &Error{Service: c.Service, Err: ctx.Err()}
+			}
+		}
+
+		if err = c.Breaker.Allow(); err != nil {
+			return &Error{Service: c.Service, Err: err}
+		}
+		var retry bool
+		retry, err = c.attempt(ctx, req.Method, req.Path, payload, out)
+		if retry {
+			c.Breaker.Failure()
+		} else {
+			c.Breaker.Success()
+		}
+		if !retry || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// attempt makes a single attempt of a request. Returns whether the attempt failed in a way that may be temporary.
+func (c *Client) attempt(ctx context.Context, method, path string, payload []byte, out interface{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(method, c.BaseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		// Report the deadline itself rather than the URL that ran into it
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return true, &Error{Service: c.Service, Err: err}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return true, &Error{Service: c.Service, Err: err}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(body, &e)
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, &Error{Service: c.Service, StatusCode: resp.StatusCode, Message: e.Error}
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			return false, fmt.Errorf("%v returned an invalid response: %v", c.Service, err)
+		}
+	}
+	return false, nil
+}
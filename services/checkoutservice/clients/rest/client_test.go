@@ -0,0 +1,106 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testClient returns a client for server that does not wait between retries.
+func testClient(server *httptest.Server) *Client {
+	c := New("testservice", server.URL, time.Second)
+	c.Backoff = 0
+	return c
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"id": "abc"}`))
+	}))
+	defer server.Close()
+
+	var out struct {
+		ID string `json:"id"`
+	}
+	err := testClient(server).Do(context.Background(), Request{Method: "GET", Path: "/"}, &out)
+
+	// The request succeeds on the third attempt
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, "abc", out.ID)
+}
+
+func TestNoRetry(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(`{"error": "card declined"}`))
+	}))
+	defer server.Close()
+
+	err := testClient(server).Do(context.Background(), Request{Method: "POST", Path: "/"}, nil)
+
+	// A request that is not idempotent is tried only once, and the error of the service is kept
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, http.StatusBadGateway, StatusCode(err))
+	assert.Equal(t, "testservice returned 502: card declined", err.Error())
+}
+
+func TestJSONBody(t *testing.T) {
+	var got map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer server.Close()
+
+	body := map[string]string{"email": `"quoted"@test.com`}
+	err := testClient(server).Do(context.Background(), Request{Method: "POST", Path: "/", Body: body}, nil)
+
+	// Quotes survive the trip
+	assert.Nil(t, err)
+	assert.Equal(t, body, got)
+}
+
+func TestTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	c := testClient(server)
+	c.Timeout = 10 * time.Millisecond
+	err := c.Do(context.Background(), Request{Method: "POST", Path: "/"}, nil)
+	assert.True(t, Timeout(err))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	c := testClient(server)
+	c.Breaker = NewBreaker(2, time.Hour)
+	for i := 0; i < 5; i++ {
+		c.Do(context.Background(), Request{Method: "POST", Path: "/"}, nil)
+	}
+
+	// After two failures the service is no longer called
+	assert.Equal(t, 2, calls)
+	err := c.Do(context.Background(), Request{Method: "POST", Path: "/"}, nil)
+	assert.True(t, CircuitOpen(err))
+}
@@ -0,0 +1,67 @@
+// Package shipping is the client of shippingservice.
+package shipping
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/clients/rest"
+)
+
+// Item is a product to ship
+type Item struct {
+	Sku string `json:"sku"`
+	Qty int    `json:"qty"`
+}
+
+// Shipment represents the payload to the shipping service
+type Shipment struct {
+	Address   string `json:"address"`
+	Method    string `json:"method"`
+	Items     []Item `json:"items"`
+	Reference string `json:"reference"`
+}
+
+// Client calls shippingservice.
+type Client struct {
+	*rest.Client
+}
+
+// New creates a client for the shippingservice at baseURL.
+func New(baseURL string) *Client {
+	return &Client{rest.New("shippingservice", baseURL, 10*time.Second)}
+}
+
+// Ship ships the products to a user. The reference identifies the shipment for a cancellation in case we never
+// learn the shipping id. A shipment is never retried, as shippingservice would ship it again.
+// Returns the shipping id.
+func (c *Client) Ship(ctx context.Context, shipment Shipment) (string, error) {
+	var resp struct {
+		ShippingID string `json:"shippingid"`
+	}
+	err := c.Do(ctx, rest.Request{
+		Method: http.MethodPost,
+		Path:   "/ship",
+		Body:   shipment,
+	}, &resp)
+	return resp.ShippingID, err
+}
+
+// Cancel cancels a shipment, identified by its shipping id or the reference it was made with.
+// A shipment that never happened needs no cancellation.
+func (c *Client) Cancel(ctx context.Context, shippingid, reference string) error {
+	err := c.Do(ctx, rest.Request{
+		Method: http.MethodPost,
+		Path:   "/cancel",
+		Body: map[string]string{
+			"shippingid": shippingid,
+			"reference":  reference,
+		},
+		Idempotent: true,
+	}, nil)
+	if rest.StatusCode(err) == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/clients/cart"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/clients/payment"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/clients/rest"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/rates"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/tax"
+	"github.com/gin-gonic/gin"
+)
+
+// The error codes a failed checkout is answered with. They never change, so clients can map them to messages.
+const (
+	codeInvalidRequest     = "invalid_request"
+	codeEmptyCart          = "empty_cart"
+	codeUnavailable        = "product_unavailable"
+	codePriceChanged       = "price_changed"
+	codeUnknownCountry     = "unsupported_country"
+	codeUnknownTaxClass    = "unsupported_product"
+	codeShippingMethod     = "invalid_shipping_method"
+	codeCartLocked         = "cart_locked"
+	codePaymentDeclined    = "payment_declined"
+	codeInvalidCard        = "invalid_card"
+	codeServiceUnavailable = "service_unavailable"
+	codeServiceTimeout     = "service_timeout"
+	codeServiceError       = "service_error"
+	codeInternal           = "internal_error"
+)
+
+// errEmptyCart is returned when a cart without items is checked out.
+var errEmptyCart = errors.New("the shopping cart is empty")
+
+// errUnavailable is returned when a cart contains products that are no longer in the catalog.
+var errUnavailable = errors.New("the shopping cart contains products that are no longer available")
+
+// PriceQuote is what a checkout costs. All amounts are in cents.
+type PriceQuote struct {
+	Currency     string           `json:"currency"`
+	Lines        []cart.QuoteLine `json:"lines"`
+	Subtotal     int              `json:"subtotal"`
+	Discount     int              `json:"discount"`
+	ShippingCost int              `json:"shipping_cost"`
+	Tax          int              `json:"tax"`
+	Total        int              `json:"total"`
+}
+
+// PriceChangedError is returned when a checkout costs another amount than the user expected to pay,
+// because prices changed after they looked at their cart. Quote is what the checkout costs now.
+type PriceChangedError struct {
+	Expected int
+	Quote    PriceQuote
+}
+
+func (e *PriceChangedError) Error() string {
+	return fmt.Sprintf("the total changed from %v to %v", e.Expected, e.Quote.Total)
+}
+
+// StepError is returned when a step of a saga fails.
+type StepError struct {
+	Step string
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return e.Step + ": " + e.Err.Error()
+}
+
+// isUnknownCountry reports whether err is an order shipped to a country we have no VAT rules or shipping rates for.
+func isUnknownCountry(err error) bool {
+	switch err.(type) {
+	case *tax.UnknownCountryError, *rates.UnknownCountryError:
+		return true
+	}
+	return false
+}
+
+// isUnknownTaxClass reports whether err is an order with a product that cannot be sold in the country it
+// is shipped to, because the country has no VAT rate for the product.
+func isUnknownTaxClass(err error) bool {
+	_, ok := err.(*tax.UnknownClassError)
+	return ok
+}
+
+// isPriceChanged reports whether err is a checkout that costs another amount than the user expected.
+func isPriceChanged(err error) bool {
+	_, ok := err.(*PriceChangedError)
+	return ok
+}
+
+// isUnavailableMethod reports whether err is an order that cannot be shipped with the chosen method.
+func isUnavailableMethod(err error) bool {
+	_, ok := err.(*rates.UnavailableError)
+	return ok
+}
+
+// errorCode returns the status code and error code to answer a failed checkout with.
+func errorCode(err error) (int, string) {
+	if stepErr, ok := err.(*StepError); ok {
+		err = stepErr.Err
+	}
+	switch {
+	case err == errEmptyCart:
+		return http.StatusBadRequest, codeEmptyCart
+	case err == errUnavailable:
+		return http.StatusConflict, codeUnavailable
+	case isPriceChanged(err):
+		return http.StatusConflict, codePriceChanged
+	case isUnknownCountry(err):
+		return http.StatusBadRequest, codeUnknownCountry
+	case isUnknownTaxClass(err):
+		return http.StatusBadRequest, codeUnknownTaxClass
+	case isUnavailableMethod(err):
+		return http.StatusBadRequest, codeShippingMethod
+	case err == cart.ErrLocked:
+		return http.StatusConflict, codeCartLocked
+	case err == payment.ErrDeclined:
+		return http.StatusPaymentRequired, codePaymentDeclined
+	case err == payment.ErrInvalidCard:
+		return http.StatusBadRequest, codeInvalidCard
+	case err == errQueueFull, rest.CircuitOpen(err):
+		return http.StatusServiceUnavailable, codeServiceUnavailable
+	case rest.Timeout(err):
+		return http.StatusGatewayTimeout, codeServiceTimeout
+	}
+	if _, ok := err.(*rest.Error); ok {
+		return http.StatusBadGateway, codeServiceError
+	}
+	return http.StatusInternalServerError, codeInternal
+}
+
+// abortWithError answers a request with err, the error code it maps to and the step of the checkout that failed.
+// A checkout whose price changed is answered with what it costs now as well.
+func abortWithError(c *gin.Context, err error) {
+	status, code := errorCode(err)
+	body := gin.H{
+		"error": err.Error(),
+		"code":  code,
+	}
+	if stepErr, ok := err.(*StepError); ok {
+		body["error"] = stepErr.Err.Error()
+		body["step"] = stepErr.Step
+		if priceErr, ok := stepErr.Err.(*PriceChangedError); ok {
+			body["expected_total"] = priceErr.Expected
+			body["quote"] = priceErr.Quote
+		}
+	}
+	c.AbortWithStatusJSON(status, body)
+}
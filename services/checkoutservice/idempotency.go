@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// IdempotencyKey records a request that was made with an Idempotency-Key header and the response it got,
+// so a retry of the request gets the same response instead of being carried out again.
+type IdempotencyKey struct {
+	Key         string `gorm:"primary_key"`
+	Fingerprint string
+	Status      int
+	Response    string `gorm:"type:text"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// responseRecorder keeps a copy of everything written to the response.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent makes a request with an Idempotency-Key header happen only once. A duplicate request replays
+// the stored response, a duplicate that arrives while the first one is still running gets 409 and reusing
+// a key for a different request gets 422. Requests without the header are handled as usual.
+// Server errors are not stored, as a failed checkout has been rolled back and may be retried.
+func idempotent(c *gin.Context) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		c.Next()
+		return
+	}
+	if len(key) > 255 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Idempotency-Key must be at most 255 characters",
+		})
+		return
+	}
+
+	// Fingerprint the request, so we can tell whether a duplicate is really the same request
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(append([]byte(c.Request.Method+" "+c.Request.URL.Path+"?"+c.Request.URL.RawQuery+"\n"), body...))
+	fingerprint := hex.EncodeToString(sum[:])
+
+	// Claim the key. If somebody else already did, this is a duplicate.
+	record := IdempotencyKey{
+		Key:         key,
+		Fingerprint: fingerprint,
+	}
+	if err := db.Create(&record).Error; err != nil {
+		var existing IdempotencyKey
+		if db.Where("key = ?", key).First(&existing).RecordNotFound() {
+			log.WithFields(log.Fields{
+				"key": key,
+			}).Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		replayResponse(c, existing, fingerprint)
+		return
+	}
+
+	// A request that panics got no response worth storing, so the key is given up and the request can be retried
+	defer func() {
+		if r := recover(); r != nil {
+			if err := db.Delete(&record).Error; err != nil {
+				log.WithFields(log.Fields{
+					"key": key,
+				}).Error(err)
+			}
+			panic(r)
+		}
+	}()
+
+	// Handle the request and store the response it got
+	recorder := &responseRecorder{ResponseWriter: c.Writer}
+	c.Writer = recorder
+	c.Next()
+
+	status := c.Writer.Status()
+	if status >= 500 {
+		err = db.Delete(&record).Error
+	} else {
+		err = db.Model(&record).Updates(IdempotencyKey{
+			Status:   status,
+			Response: recorder.body.String(),
+		}).Error
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"key": key,
+		}).Error(err)
+	}
+}
+
+// replayResponse answers a duplicate of the request that was made with the same idempotency key.
+func replayResponse(c *gin.Context, existing IdempotencyKey, fingerprint string) {
+	if existing.Fingerprint != fingerprint {
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+			"error": "Idempotency-Key was already used for a different request",
+		})
+		return
+	}
+	if existing.Status == 0 {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": "a request with this Idempotency-Key is still being processed",
+		})
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"key":    existing.Key,
+		"status": existing.Status,
+	}).Info("Replayed idempotent request")
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(existing.Status, "application/json; charset=utf-8", []byte(existing.Response))
+	c.Abort()
+}
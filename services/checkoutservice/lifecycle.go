@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+// The statuses an order can have
+const (
+	orderPending   = "pending"
+	orderPaid      = "paid"
+	orderFulfilled = "fulfilled"
+	orderShipped   = "shipped"
+	orderDelivered = "delivered"
+	orderCancelled = "cancelled"
+	orderRefunded  = "refunded"
+)
+
+// orderTransitions lists the statuses an order can move to from each status. Cancelled and refunded orders are final.
+var orderTransitions = map[string][]string{
+	orderPending:   {orderPaid, orderCancelled},
+	orderPaid:      {orderFulfilled, orderCancelled, orderRefunded},
+	orderFulfilled: {orderShipped, orderCancelled, orderRefunded},
+	orderShipped:   {orderDelivered, orderRefunded},
+	orderDelivered: {orderRefunded},
+	orderCancelled: {},
+	orderRefunded:  {},
+}
+
+// OrderTransition records a single status change of an Order.
+type OrderTransition struct {
+	ID        uint      `json:"-" gorm:"primary_key"`
+	OrderID   string    `json:"-" gorm:"index"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// errOrderNotFound is returned when an order does not exist.
+var errOrderNotFound = errors.New("not found")
+
+// errOrderChanged is returned when an order changed status while it was being transitioned.
+var errOrderChanged = errors.New("the order changed status while it was being updated, try again")
+
+// IllegalTransitionError is returned when an order cannot move from its current status to the requested one.
+type IllegalTransitionError struct {
+	From    string
+	To      string
+	Allowed []string
+}
+
+func (e *IllegalTransitionError) Error() string {
+	return fmt.Sprintf("cannot transition an order from %v to %v", e.From, e.To)
+}
+
+// canTransition reports whether an order can move from one status to another.
+func canTransition(from, to string) bool {
+	for _, s := range orderTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionOrder moves the order with the given ID to a new status and records the change in its history.
+// The status only changes if the order still has the status it was read with, so two concurrent transitions
+// can never both succeed.
+func transitionOrder(id, to, reason string) (Order, error) {
+	var order Order
+	if db.Where("id = ?", id).First(&order).RecordNotFound() {
+		return order, errOrderNotFound
+	}
+	if !canTransition(order.Status, to) {
+		return order, &IllegalTransitionError{order.Status, to, orderTransitions[order.Status]}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Order{}).Where("id = ? AND status = ?", id, order.Status).Update("status", to)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errOrderChanged
+		}
+		return tx.Create(&OrderTransition{OrderID: id, From: order.Status, To: to, Reason: reason}).Error
+	})
+	if err != nil {
+		return order, err
+	}
+
+	log.WithFields(log.Fields{
+		"order": id,
+		"from":  order.Status,
+		"to":    to,
+	}).Info("Transitioned order")
+	return loadOrder(id)
+}
+
+// loadOrder fetches an order with its items, status history and refunds.
+func loadOrder(id string) (Order, error) {
+	var order Order
+	err := db.Preload("Items").Preload("History", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Preload("Refunds", func(db *gorm.DB) *gorm.DB {
+		return db.Order("created_at")
+	}).Preload("Refunds.Lines").Where("id = ?", id).First(&order).Error
+	if gorm.IsRecordNotFoundError(err) {
+		err = errOrderNotFound
+	}
+	return order, err
+}
+
+// postTransition moves an order to the status in the request body. An illegal transition is rejected with 409
+// and the statuses the order can move to.
+func postTransition(c *gin.Context) {
+
+	// Get the order ID and the requested status
+	id := c.Param("id")
+	var body struct {
+		Status string `json:"status" binding:"required"`
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if _, ok := orderTransitions[body.Status]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("unknown order status %v", body.Status),
+		})
+		return
+	}
+
+	// Cancelling and refunding an order return money, which only their own endpoints do
+	if endpoint, ok := map[string]string{orderCancelled: "cancel", orderRefunded: "refund"}[body.Status]; ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("use POST /order/%v/%v to move an order to %v", id, endpoint, body.Status),
+		})
+		return
+	}
+
+	// Transition the order
+	order, err := transitionOrder(id, body.Status, body.Reason)
+	if illegal, ok := err.(*IllegalTransitionError); ok {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   illegal.Error(),
+			"status":  illegal.From,
+			"allowed": illegal.Allowed,
+		})
+		return
+	}
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, order)
+	case errOrderNotFound:
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+	case errOrderChanged:
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+	default:
+		log.WithFields(log.Fields{
+			"order": id,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The services share no code, so the masking below is the same as that of services/frontendservice/card.go.
+// Change both together.
+
+// cardNumbers matches what could be a card number in a log line, 12 to 19 digits optionally grouped
+// with spaces or dashes
+var cardNumbers = regexp.MustCompile(`\b[0-9](?:[ -]?[0-9]){11,18}\b`)
+
+// luhnValid reports whether a number of only digits has a valid Luhn check digit, as card numbers do.
+func luhnValid(number string) bool {
+	var sum int
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// maskCardNumbers replaces every card number in s with stars, keeping its last four digits.
+func maskCardNumbers(s string) string {
+	return cardNumbers.ReplaceAllStringFunc(s, func(match string) string {
+		number := strings.NewReplacer(" ", "", "-", "").Replace(match)
+		if !luhnValid(number) {
+			return match
+		}
+		return strings.Repeat("*", len(number)-4) + number[len(number)-4:]
+	})
+}
+
+// cardFields are log fields that hold card data, which are never logged at all
+var cardFields = map[string]bool{
+	"card":       true,
+	"creditcard": true,
+	"card_token": true,
+	"cvv":        true,
+}
+
+// maskHook masks card data in everything that is logged.
+type maskHook struct{}
+
+func (maskHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (maskHook) Fire(entry *log.Entry) error {
+	entry.Message = maskCardNumbers(entry.Message)
+	for k, v := range entry.Data {
+		if cardFields[strings.ToLower(k)] {
+			entry.Data[k] = "[masked]"
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			entry.Data[k] = maskCardNumbers(v)
+		case error:
+			entry.Data[k] = maskCardNumbers(v.Error())
+		}
+	}
+	return nil
+}
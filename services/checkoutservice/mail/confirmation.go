@@ -0,0 +1,170 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+// Confirmation is what an order confirmation tells the customer. All amounts are in cents.
+type Confirmation struct {
+	OrderID        string
+	Email          string
+	Address        string
+	Country        string
+	Currency       string
+	Lines          []Line
+	Subtotal       int
+	Discount       int
+	ShippingMethod string
+	Shipping       int
+	TransactionID  string
+	ShippingID     string
+
+	// Tax is the VAT on the order, which is part of the prices when TaxIncluded is set and added on top otherwise
+	Tax         int
+	TaxIncluded bool
+
+	// Total is what was charged, shipping included
+	Total int
+}
+
+// Line is a single ordered product.
+type Line struct {
+	Sku       string
+	Name      string
+	Qty       int
+	UnitPrice int
+	LineTotal int
+}
+
+// currencySymbols are written in front of amounts instead of their currency code
+var currencySymbols = map[string]string{
+	"EUR": "€",
+	"USD": "$",
+	"GBP": "£",
+}
+
+// money formats an amount in cents, for example as €12.50.
+func money(currency string, cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	if currency == "" {
+		currency = "EUR"
+	}
+	symbol, ok := currencySymbols[currency]
+	if !ok {
+		symbol = currency + " "
+	}
+	return fmt.Sprintf("%v%v%d.%02d", sign, symbol, cents/100, cents%100)
+}
+
+const confirmationText = `Thank you for your order!
+
+We have received your payment and your order is on its way.
+
+Order ID:       {{ .OrderID }}
+Transaction ID: {{ .TransactionID }}
+Tracking ID:    {{ .ShippingID }}
+
+{{ range .Lines -}}
+{{ .Qty }} x {{ .Name }} ({{ .Sku }}) at {{ money $.Currency .UnitPrice }}: {{ money $.Currency .LineTotal }}
+{{ end }}
+Subtotal: {{ money .Currency .Subtotal }}
+{{- if .Discount }}
+Discount: -{{ money .Currency .Discount }}
+{{- end }}
+Shipping ({{ .ShippingMethod }}): {{ money .Currency .Shipping }}
+{{ if .TaxIncluded }}Including VAT{{ else }}VAT{{ end }}: {{ money .Currency .Tax }}
+Total: {{ money .Currency .Total }}
+
+Shipping to:
+{{ .Address }}
+{{ .Country }}
+`
+
+const confirmationHTML = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; color: #212529;">
+    <h2>Thank you for your order!</h2>
+    <p>We have received your payment and your order is on its way.</p>
+    <p>
+        Order ID: <strong>{{ .OrderID }}</strong><br>
+        Transaction ID: <strong>{{ .TransactionID }}</strong><br>
+        Tracking ID: <strong>{{ .ShippingID }}</strong>
+    </p>
+    <table cellpadding="6" style="border-collapse: collapse;">
+        <tr style="border-bottom: 1px solid #dee2e6;">
+            <th align="left">Product</th>
+            <th align="right">Quantity</th>
+            <th align="right">Price</th>
+            <th align="right">Total</th>
+        </tr>
+        {{- range .Lines }}
+        <tr>
+            <td>{{ .Name }} <small>({{ .Sku }})</small></td>
+            <td align="right">{{ .Qty }}</td>
+            <td align="right">{{ money $.Currency .UnitPrice }}</td>
+            <td align="right">{{ money $.Currency .LineTotal }}</td>
+        </tr>
+        {{- end }}
+        <tr style="border-top: 1px solid #dee2e6;">
+            <td colspan="3">Subtotal</td>
+            <td align="right">{{ money .Currency .Subtotal }}</td>
+        </tr>
+        {{- if .Discount }}
+        <tr>
+            <td colspan="3">Discount</td>
+            <td align="right">-{{ money .Currency .Discount }}</td>
+        </tr>
+        {{- end }}
+        <tr>
+            <td colspan="3">Shipping ({{ .ShippingMethod }})</td>
+            <td align="right">{{ money .Currency .Shipping }}</td>
+        </tr>
+        <tr>
+            <td colspan="3">{{ if .TaxIncluded }}Including VAT{{ else }}VAT{{ end }}</td>
+            <td align="right">{{ money .Currency .Tax }}</td>
+        </tr>
+        <tr>
+            <td colspan="3"><strong>Total</strong></td>
+            <td align="right"><strong>{{ money .Currency .Total }}</strong></td>
+        </tr>
+    </table>
+    <p>
+        Shipping to:<br>
+        {{ .Address }}<br>
+        {{ .Country }}
+    </p>
+</body>
+</html>
+`
+
+var (
+	confirmationTextTemplate = texttemplate.Must(texttemplate.New("confirmation").
+					Funcs(texttemplate.FuncMap{"money": money}).Parse(confirmationText))
+	confirmationHTMLTemplate = htmltemplate.Must(htmltemplate.New("confirmation").
+					Funcs(htmltemplate.FuncMap{"money": money}).Parse(confirmationHTML))
+)
+
+// RenderConfirmation renders the confirmation of an order, sent from the address from to the customer.
+func RenderConfirmation(from string, c Confirmation) (Message, error) {
+	var text, html bytes.Buffer
+	if err := confirmationTextTemplate.Execute(&text, c); err != nil {
+		return Message{}, err
+	}
+	if err := confirmationHTMLTemplate.Execute(&html, c); err != nil {
+		return Message{}, err
+	}
+	return Message{
+		From:    from,
+		To:      c.Email,
+		Subject: fmt.Sprintf("Your order %v is confirmed", c.OrderID),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
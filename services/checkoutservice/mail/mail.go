@@ -0,0 +1,97 @@
+// Package mail renders the emails we send customers and sends them through a pluggable transport.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Message is an email with a plain-text and an HTML version of the same content.
+type Message struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html"`
+}
+
+// Transport delivers messages.
+type Transport interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// Bytes encodes the message as a multipart/alternative MIME message, ready to be handed to an SMTP server.
+func (m Message) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	parts := multipart.NewWriter(&buf)
+
+	// Write the headers. The addresses are parsed and written anew, so they cannot smuggle in headers of their own.
+	from, err := netmail.ParseAddress(m.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := netmail.ParseAddress(m.To)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	headers := []struct{ name, value string }{
+		{"From", from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%v@%v>", hex.EncodeToString(id), domain(from.Address))},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + parts.Boundary()},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&buf, "%v: %v\r\n", h.name, h.value)
+	}
+	buf.WriteString("\r\n")
+
+	// Followed by the plain-text version and the HTML version, which clients prefer as it comes last
+	for _, p := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(p.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// domain returns the domain of an email address.
+func domain(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return address[i+1:]
+	}
+	return "localhost"
+}
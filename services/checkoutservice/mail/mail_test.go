@@ -0,0 +1,151 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// smtpServer is a stand-in for an SMTP server that accepts every message and hands it to received.
+func smtpServer(t *testing.T, received chan<- string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+			case "EHLO", "HELO":
+				tp.PrintfLine("250 localhost")
+			case "MAIL", "RCPT", "RSET", "NOOP":
+				tp.PrintfLine("250 OK")
+			case "DATA":
+				tp.PrintfLine("354 Go ahead")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				received <- string(data)
+				tp.PrintfLine("250 Queued")
+			case "QUIT":
+				tp.PrintfLine("221 Bye")
+				return
+			default:
+				tp.PrintfLine("502 Not implemented")
+			}
+		}
+	}()
+	return l.Addr().String()
+}
+
+var confirmation = Confirmation{
+	OrderID:  "abc123",
+	Email:    "test@test.com",
+	Address:  "testlane 1",
+	Country:  "NL",
+	Currency: "EUR",
+	Lines: []Line{
+		{Sku: "SKU1", Name: "Mug <large>", Qty: 2, UnitPrice: 1250, LineTotal: 2500},
+	},
+	Subtotal:       2500,
+	Discount:       250,
+	ShippingMethod: "standard",
+	Shipping:       495,
+	TransactionID:  "tx-1",
+	ShippingID:     "ship-1",
+	Tax:            390,
+	TaxIncluded:    true,
+	Total:          2745,
+}
+
+func TestRenderConfirmation(t *testing.T) {
+	m, err := RenderConfirmation("Shop <orders@shop.test>", confirmation)
+	assert.Nil(t, err)
+	assert.Equal(t, "test@test.com", m.To)
+	assert.Contains(t, m.Subject, "abc123")
+
+	// Both versions describe the whole order
+	for _, body := range []string{m.Text, m.HTML} {
+		assert.Contains(t, body, "tx-1")
+		assert.Contains(t, body, "ship-1")
+		assert.Contains(t, body, "€12.50")
+		assert.Contains(t, body, "-€2.50")
+		assert.Contains(t, body, "€4.95")
+		assert.Contains(t, body, "Including VAT")
+		assert.Contains(t, body, "€27.45")
+		assert.Contains(t, body, "testlane 1")
+	}
+	assert.Contains(t, m.Text, "2 x Mug <large> (SKU1)")
+
+	// And the HTML version escapes what it shows
+	assert.Contains(t, m.HTML, "Mug &lt;large&gt;")
+}
+
+func TestRenderRefund(t *testing.T) {
+	notice := RefundNotice{
+		OrderID:  "abc123",
+		Email:    "test@test.com",
+		Currency: "EUR",
+		Lines:    []Line{{Sku: "SKU1", Name: "Mug <large>", Qty: 1}},
+		Amount:   1125,
+		Reason:   "broken",
+	}
+	m, err := RenderRefund("Shop <orders@shop.test>", notice)
+	assert.Nil(t, err)
+	assert.Equal(t, "Your refund for order abc123", m.Subject)
+	for _, body := range []string{m.Text, m.HTML} {
+		assert.Contains(t, body, "€11.25")
+		assert.Contains(t, body, "broken")
+	}
+	assert.Contains(t, m.Text, "1 x Mug <large> (SKU1)")
+	assert.Contains(t, m.HTML, "Mug &lt;large&gt;")
+
+	// A cancellation says so
+	notice.Cancelled = true
+	m, _ = RenderRefund("Shop <orders@shop.test>", notice)
+	assert.Equal(t, "Your order abc123 has been cancelled", m.Subject)
+	assert.Contains(t, m.Text, "has been cancelled")
+}
+
+func TestSMTP(t *testing.T) {
+	received := make(chan string, 1)
+	addr := smtpServer(t, received)
+
+	m, _ := RenderConfirmation("Shop <orders@shop.test>", confirmation)
+	err := NewSMTP(addr, "", "").Send(context.Background(), m)
+	assert.Nil(t, err)
+
+	// The server gets a multipart message with both versions
+	data := <-received
+	msg, err := textproto.NewReader(bufio.NewReader(strings.NewReader(data))).ReadMIMEHeader()
+	assert.Nil(t, err)
+	assert.Equal(t, `"Shop" <orders@shop.test>`, msg.Get("From"))
+	assert.Equal(t, "<test@test.com>", msg.Get("To"))
+	assert.Contains(t, msg.Get("Content-Type"), "multipart/alternative")
+	assert.Contains(t, data, "Content-Type: text/plain; charset=utf-8")
+	assert.Contains(t, data, "Content-Type: text/html; charset=utf-8")
+	assert.Contains(t, data, "abc123")
+}
+
+func TestInvalidAddress(t *testing.T) {
+	m := Message{From: "orders@shop.test", To: "test@test.com\r\nBcc: everyone@test.com"}
+	_, err := m.Bytes()
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,83 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+// RefundNotice tells a customer that (part of) their order was refunded, or that it was cancelled.
+// Amount is in cents.
+type RefundNotice struct {
+	OrderID   string
+	Email     string
+	Currency  string
+	Lines     []Line
+	Amount    int
+	Reason    string
+	Cancelled bool
+}
+
+const refundText = `{{ if .Cancelled }}Your order {{ .OrderID }} has been cancelled.{{ else }}We have refunded (part of) your order {{ .OrderID }}.{{ end }}
+{{ if .Reason }}
+Reason: {{ .Reason }}
+{{ end }}
+{{ range .Lines -}}
+{{ .Qty }} x {{ .Name }} ({{ .Sku }})
+{{ end }}
+Refunded: {{ money .Currency .Amount }}
+
+The refund is made to the card you paid with and can take a few days to show up.
+`
+
+const refundHTML = `<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; color: #212529;">
+    {{- if .Cancelled }}
+    <h2>Your order {{ .OrderID }} has been cancelled</h2>
+    {{- else }}
+    <h2>We have refunded (part of) your order {{ .OrderID }}</h2>
+    {{- end }}
+    {{- if .Reason }}
+    <p>Reason: {{ .Reason }}</p>
+    {{- end }}
+    <ul>
+        {{- range .Lines }}
+        <li>{{ .Qty }} x {{ .Name }} <small>({{ .Sku }})</small></li>
+        {{- end }}
+    </ul>
+    <p>Refunded: <strong>{{ money .Currency .Amount }}</strong></p>
+    <p>The refund is made to the card you paid with and can take a few days to show up.</p>
+</body>
+</html>
+`
+
+var (
+	refundTextTemplate = texttemplate.Must(texttemplate.New("refund").
+				Funcs(texttemplate.FuncMap{"money": money}).Parse(refundText))
+	refundHTMLTemplate = htmltemplate.Must(htmltemplate.New("refund").
+				Funcs(htmltemplate.FuncMap{"money": money}).Parse(refundHTML))
+)
+
+// RenderRefund renders a refund notice, sent from the address from to the customer.
+func RenderRefund(from string, n RefundNotice) (Message, error) {
+	var text, html bytes.Buffer
+	if err := refundTextTemplate.Execute(&text, n); err != nil {
+		return Message{}, err
+	}
+	if err := refundHTMLTemplate.Execute(&html, n); err != nil {
+		return Message{}, err
+	}
+	subject := fmt.Sprintf("Your refund for order %v", n.OrderID)
+	if n.Cancelled {
+		subject = fmt.Sprintf("Your order %v has been cancelled", n.OrderID)
+	}
+	return Message{
+		From:    from,
+		To:      n.Email,
+		Subject: subject,
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
@@ -0,0 +1,101 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"time"
+)
+
+// SMTP delivers messages to an SMTP server. The connection is upgraded with STARTTLS when the server offers it,
+// and authenticated when a username is set.
+type SMTP struct {
+	Addr     string
+	Username string
+	Password string
+
+	// Timeout limits how long sending a single message may take, when the context does not limit it already
+	Timeout time.Duration
+}
+
+// NewSMTP creates a transport for the SMTP server at addr, which is a host:port.
+func NewSMTP(addr, username, password string) *SMTP {
+	return &SMTP{
+		Addr:     addr,
+		Username: username,
+		Password: password,
+		Timeout:  30 * time.Second,
+	}
+}
+
+// Send delivers the message to the SMTP server.
+func (t *SMTP) Send(ctx context.Context, m Message) error {
+	from, err := netmail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+	to, err := netmail.ParseAddress(m.To)
+	if err != nil {
+		return err
+	}
+	data, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(t.Addr)
+	if err != nil {
+		return err
+	}
+
+	// Connect, giving up when the context is done or the timeout passes
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", t.Addr)
+	if err != nil {
+		return err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(t.Timeout)
+	}
+	conn.SetDeadline(deadline)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	// Secure and authenticate the connection
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if t.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", t.Username, t.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	// And hand over the message
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := bytes.NewReader(data).WriteTo(w); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"os"
-
+	"strconv"
+	"time"
+
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/clients/cart"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/clients/email"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/clients/payment"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/clients/shipping"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/mail"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/rates"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/tax"
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 	ginlogrus "github.com/toorop/gin-logrus"
@@ -17,178 +24,44 @@ import (
 
 var (
 	cartservice     = mustMapEnv("CARTSERVICE")
-	emailservice    = mustMapEnv("EMAILSERVICE")
 	paymentservice  = mustMapEnv("PAYMENTSERVICE")
 	shippingservice = mustMapEnv("SHIPPINGSERVICE")
-	productservice  = mustMapEnv("PRODUCTSERVICE")
-)
-
-// Checkout represents the information required to perform a succesful checkout.
-type Checkout struct {
-	SessionID  string `json:"sessionid" binding:"required"`
-	Address    string `json:"address" binding:"required"`
-	Email      string `json:"email" binding:"required"`
-	Creditcard string `json:"creditcard" binding:"required"`
-}
-
-// Cart represents the shopping cart model
-type Cart struct {
-	Items []Item `json:"items"`
-}
-
-// Item represents the items in a Cart
-type Item struct {
-	Sku string `json:"sku"`
-	Qty int    `json:"qty"`
-}
-
-// Ship represents the payload to the shipping service
-type Ship struct {
-	Address string `json:"address"`
-	Items   []Item `json:"items"`
-}
-
-// getShoppingCart calls cartservice to get a shopping cart. Returns type Cart, which may be empty.
-func getShoppingCart(sessionid string) (Cart, error) {
-
-	// Make the request to the cart service
-	url := fmt.Sprintf("%v/cart/%v", cartservice, sessionid)
-	resp, err := http.Get(url)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"url": url,
-		}).Error(err)
-		return Cart{}, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		err := errors.New("failed to get shopping cart")
-		return Cart{}, err
-	}
-
-	// Read HTTP body
-	result, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Error(err)
-	}
-
-	// Unmarshal the JSON into our Cart struct
-	var cart Cart
-	err = json.Unmarshal(result, &cart)
-	if err != nil {
-		log.Error(err)
-	}
-
-	// Return the shopping cart
-	return cart, err
-}
-
-// payProduct calls paymentservice to charge a creditcard. Returns the transaction id as a string.
-func payProduct(creditcard string, amount int) (string, error) {
-
-	// Make the request to the payment service
-	log.Println("Calling service paymentservice...")
-	url := fmt.Sprintf("%v/payment", paymentservice)
-	payload := []byte(fmt.Sprintf(`{"creditcard": "%v", "amount": %v}`, creditcard, amount))
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(payload))
-	if err != nil {
-		log.WithFields(log.Fields{
-			"url": url,
-		}).Error(err)
-		return "", err
-	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		err := errors.New("failed to process payment")
-		return "", err
-	}
+	carts     = cart.New(cartservice)
+	payments  = payment.New(paymentservice)
+	shipments = shipping.New(shippingservice)
 
-	// Read HTTP body
-	result, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Error(err)
-	}
-
-	// Unmarshal results
-	type PaymentResponse struct {
-		TransactionID string `json:"transactionid"`
-	}
-	var paymentresponse PaymentResponse
-	json.Unmarshal(result, &paymentresponse)
-
-	return paymentresponse.TransactionID, err
-}
-
-// shipProduct calls shipservice to ship the products to a user. Returns the shipping id as a string.
-func shipProduct(address string, products []Item) (string, error) {
-
-	// Convert products to our Ship struct
-	ship := Ship{
-		Address: address,
-		Items:   products,
-	}
-
-	// Make the request to the shipping service
-	log.Println("Calling service shippingservice...")
-	url := fmt.Sprintf("%v/ship", shippingservice)
-	payload, _ := json.Marshal(ship)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(payload))
-	if err != nil {
-		log.WithFields(log.Fields{
-			"url": url,
-		}).Error(err)
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		err := errors.New("failed to process shipment")
-		return "", err
-	}
-
-	// Read HTTP body
-	result, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Error(err)
-	}
+	// emails delivers the emails we send, through SMTP when SMTP_ADDR is set and emailservice otherwise
+	emails   mail.Transport
+	mailFrom = "Microservices Shop <orders@microservices-shop.local>"
 
-	// Unmarshal results
-	type ShipResponse struct {
-		ShippingID string `json:"shippingid"`
-	}
-	var shipresponse ShipResponse
-	json.Unmarshal(result, &shipresponse)
+	taxRules      = tax.DefaultRules
+	shippingRates = rates.DefaultTable
+)
 
-	return shipresponse.ShippingID, err
+// Checkout represents the information required to perform a succesful checkout.
+type Checkout struct {
+	SessionID string `json:"sessionid" binding:"required"`
+	Address   string `json:"address" binding:"required"`
+	Email     string `json:"email" binding:"required"`
 
-}
+	// CardToken is the token the paymentservice vault gave for the card to pay with. Raw card numbers are refused.
+	CardToken string `json:"card_token" binding:"required"`
 
-// sendEmail calls the emailservice to send the user an order confirmation email.
-func sendEmail(email string) error {
-	// Make the request to the email service
-	log.Println("Calling service emailservice...")
-	url := fmt.Sprintf("%v/email", emailservice)
-	payload := []byte(fmt.Sprintf(`{"email": "%v"}`, email))
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(payload))
-	if err != nil {
-		log.WithFields(log.Fields{
-			"url": url,
-		}).Error(err)
-		return err
-	}
-	defer resp.Body.Close()
+	// ShippingMethod is one of the methods GET /shipping/quote returns for the cart
+	ShippingMethod string `json:"shipping_method" binding:"required"`
 
-	if resp.StatusCode != 200 {
-		err := errors.New("failed to send confirmation email")
-		return err
-	}
+	// Country is the ISO code of the country the order is shipped to, which decides the VAT. Defaults to NL.
+	Country string `json:"country"`
 
-	return err
+	// ExpectedTotal is the total in cents the user saw, shipping included. When it is set and the checkout costs
+	// anything else, the checkout is refused with 409 and what it costs now.
+	ExpectedTotal *int `json:"expected_total"`
 }
 
-// checkout orchestrates the checkout process.
+// checkout orchestrates the checkout process. With ?async=true the cart is reserved and priced right away, after
+// which the checkout is queued for a worker and answered with 202. Its progress can then be followed at
+// GET /checkout/:id/status or /checkout/:id/events.
 func checkout(c *gin.Context) {
 
 	// Get the JSON data
@@ -197,83 +70,79 @@ func checkout(c *gin.Context) {
 		log.Error(err)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
+			"code":  codeInvalidRequest,
 		})
 		return
 	}
 
-	// Get the users shopping cart
-	cart, err := getShoppingCart(checkout.SessionID)
-	if err != nil {
-		log.Error(err)
+	if maskCardNumbers(checkout.CardToken) != checkout.CardToken {
+		log.WithFields(log.Fields{
+			"sessionid": checkout.SessionID,
+		}).Error("Refused a checkout with a raw card number")
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "card_token must be a card token, not a card number",
+			"code":  codeInvalidRequest,
+		})
 		return
 	}
 
-	// Count up the price and charge the users creditcard
-	// Get price at productservice
-	var total int
-	for _, v := range cart.Items {
-
-		// Get the price of the SKU by calling the Products service
-		log.Println("Calling service productservice...")
-		url := fmt.Sprintf("%v/product/%v", productservice, v.Sku)
-		resp, err := http.Get(url)
+	// Run the checkout as a saga, which undoes what was done when a step fails
+	saga, err := newSaga(checkout)
+	if c.Query("async") == "true" {
+		if err == nil {
+			err = runSteps(saga, checkoutSteps, stepPayment)
+		}
+		if err == nil {
+			err = enqueueSaga(saga)
+		}
 		if err != nil {
 			log.WithFields(log.Fields{
-				"url": url,
+				"sessionid": checkout.SessionID,
 			}).Error(err)
-			return
-		}
-		defer resp.Body.Close()
-
-		// Read HTTP body
-		result, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Error(err)
+			abortWithError(c, err)
 			return
 		}
 
-		// Unmarshal JSON into struct
-		type ProductResponse struct {
-			Price int `json:"price"`
-		}
-		var pr ProductResponse
-		json.Unmarshal(result, &pr)
-
-		// Add the price of this SKU to the total amount
-		total = total + (pr.Price * v.Qty)
-	}
-
-	// Charge the user by calling the Payments service
-	transactionid, err := payProduct(checkout.Creditcard, total)
-	if err != nil {
-		log.Error(err)
+		// Tell the client where to follow the checkout
+		statusURL := "/checkout/" + saga.ID + "/status"
+		c.Header("Location", statusURL)
+		c.JSON(
+			http.StatusAccepted,
+			gin.H{
+				"orderid":    saga.ID,
+				"status":     sagaRunning,
+				"status_url": statusURL,
+				"events_url": "/checkout/" + saga.ID + "/events",
+			},
+		)
 		return
 	}
-
-	// Ship the products to the user
-	shippingid, err := shipProduct(checkout.Address, cart.Items)
-	if err != nil {
-		log.Error(err)
-		return
+	if err == nil {
+		err = runSaga(saga, checkoutSteps)
 	}
-
-	// Send the user an email
-	err = sendEmail(checkout.Email)
 	if err != nil {
-		log.Error(err)
+		log.WithFields(log.Fields{
+			"sessionid": checkout.SessionID,
+		}).Error(err)
+		abortWithError(c, err)
 		return
 	}
 
 	// Return checkout success and ID's
 	log.WithFields(log.Fields{
 		"sessionid": checkout.SessionID,
-		"total":     total / 100,
+		"saga":      saga.ID,
+		"total":     saga.Total / 100,
 	}).Info("Checked out user")
 	c.JSON(
 		http.StatusOK,
 		gin.H{
-			"transactionid": transactionid,
-			"shippingid":    shippingid,
+			"orderid":       saga.ID,
+			"transactionid": saga.TransactionID,
+			"shippingid":    saga.ShippingID,
+			"total":         saga.Total,
+			"shipping_cost": saga.ShippingCost,
+			"tax":           saga.tax(),
 		},
 	)
 }
@@ -288,22 +157,116 @@ func setupRouter() *gin.Engine {
 	logger := logrus.New()
 	logger.SetFormatter(&log.JSONFormatter{})
 	logger.SetOutput(os.Stdout)
+	logger.AddHook(maskHook{})
 	router.Use(ginlogrus.Logger(logger), gin.Recovery())
 
-	router.POST("/checkout", checkout)
+	router.POST("/checkout", idempotent, checkout)
+	router.GET("/checkout/:id/status", getCheckoutStatus)
+	router.GET("/checkout/:id/events", streamCheckoutStatus)
+	router.GET("/order/:id", getOrder)
+	router.GET("/orders", getOrders)
+	router.POST("/order/:id/transition", postTransition)
+	router.POST("/order/:id/cancel", postCancel)
+	router.POST("/order/:id/refund", postRefund)
+	router.GET("/shipping/quote", getShippingQuote)
 	router.GET("/health", healthCheck)
 	return router
 }
 
+var db *gorm.DB
+
+// init initializes our Postgres database, which holds the state of every checkout and the orders that were placed,
+// and starts the workers that run asynchronous checkouts
 func init() {
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetOutput(os.Stdout)
+	log.AddHook(maskHook{})
+
+	// Replace the default VAT rules if others are configured
+	if rules := os.Getenv("TAX_RULES"); rules != "" {
+		var err error
+		if taxRules, err = tax.Parse([]byte(rules)); err != nil {
+			log.Panicf("Invalid TAX_RULES: %v", err)
+		}
+	}
+
+	// And the default shipping rates
+	if table := os.Getenv("SHIPPING_RATES"); table != "" {
+		var err error
+		if shippingRates, err = rates.Parse([]byte(table)); err != nil {
+			log.Panicf("Invalid SHIPPING_RATES: %v", err)
+		}
+	}
+
+	// Pick how emails are delivered
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		emails = mail.NewSMTP(addr, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	} else {
+		emails = email.New(mustMapEnv("EMAILSERVICE"))
+	}
+	if from := os.Getenv("MAIL_FROM"); from != "" {
+		mailFrom = from
+	}
+
+	// Setup the database connection
+	var err error
+	username := "postgres"
+	password := mustMapEnv("DB_PASS")
+	dbName := os.Getenv("DB_NAME")
+	if dbName == "" {
+		dbName = "checkout"
+	}
+	dbHost := mustMapEnv("DB_HOST")
+	dbURI := fmt.Sprintf("host=%s user=%s dbname=%s sslmode=disable password=%s", dbHost, username, dbName, password)
+
+	log.Printf("Connecting to database on host '%v'...", dbHost)
+	db, err = gorm.Open("postgres", dbURI)
+	if err != nil {
+		// Retry a couple times
+		counter := 3
+		for counter > 0 {
+			db, err = gorm.Open("postgres", dbURI)
+			if err != nil {
+				log.Println(err)
+				log.Printf("Could not connect to database on host '%v', trying %v more time(s)", dbHost, counter)
+				counter--
+				time.Sleep(2 * time.Second)
+
+				if counter == 0 {
+					log.Panicf("Could not connect to database on host '%v'.", dbHost)
+					break
+				}
+				continue
+			}
+			break
+		}
+	}
+	log.Printf("Successfully connected to database on host '%v'...", dbHost)
+
+	// Migrate the schema
+	db.AutoMigrate(&Saga{}, &IdempotencyKey{}, &Order{}, &OrderItem{}, &OrderTransition{}, &Refund{}, &RefundLine{})
+
+	// Start the checkout workers, of which CHECKOUT_WORKERS can set the number
+	workers := defaultWorkers
+	if n := os.Getenv("CHECKOUT_WORKERS"); n != "" {
+		if workers, err = strconv.Atoi(n); err != nil || workers < 1 {
+			log.Panicf("Invalid CHECKOUT_WORKERS: %v", n)
+		}
+	}
+	startWorkers(workers, queueSize)
 }
 
 func main() {
 	// Start HTTP server
 	gin.SetMode(gin.ReleaseMode)
 	r := setupRouter()
+
+	// Keep the checkouts we run to ourselves, finish or roll back the ones other instances abandoned,
+	// and pay out pending refunds
+	go heartbeatSagas(sagaHeartbeat)
+	go resumeSagas(checkoutSteps, sagaLease)
+	go retryRefunds(refundRetryInterval)
+
 	log.Println("Service checkoutservice started. Now accepting connections...")
 	r.Run(":8080")
 }
@@ -2,25 +2,69 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"regexp"
 	"testing"
+	"time"
 
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/clients/cart"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/rates"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/tax"
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
 
+// sessionToken signs a session ID the way frontendservice does, so cartservice accepts it.
+func sessionToken(id string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("SESSION_SECRET")))
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// fillCart adds a product to a shopping cart in cartservice, so it can be checked out.
+func fillCart(t *testing.T, sessionid string) {
+	req, _ := http.NewRequest("POST", os.Getenv("CARTSERVICE")+"/cart/"+sessionid, bytes.NewBufferString(`{"items": [{"sku": "SKU1", "qty": 1}]}`))
+	resp, err := http.DefaultClient.Do(req)
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, 201, resp.StatusCode)
+	}
+}
+
+// cardToken tokenizes a card at paymentservice, so it can be paid with.
+func cardToken(t *testing.T, number string) string {
+	resp, err := http.Post(os.Getenv("PAYMENTSERVICE")+"/tokenize", "application/json",
+		bytes.NewBufferString(`{"number": "`+number+`", "exp_month": 12, "exp_year": 2099, "cvv": "123"}`))
+	if !assert.Nil(t, err) {
+		return ""
+	}
+	defer resp.Body.Close()
+	var token struct {
+		Token string `json:"token"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&token)
+	return token.Token
+}
+
 func TestCheckout(t *testing.T) {
 	router := setupRouter()
 	w := httptest.NewRecorder()
 
 	ck := Checkout{
-		SessionID:  "sessiontest",
-		Address:    "testlane 1",
-		Email:      "test@test.com",
-		Creditcard: "123-456-789cc",
+		SessionID:      sessionToken("7c4a8d09-ca37-42e4-8a3f-6f1c3bd1e0b2"),
+		Address:        "testlane 1",
+		Email:          "test@test.com",
+		CardToken:      cardToken(t, "4432-8015-6152-0454"),
+		ShippingMethod: "standard",
 	}
+	fillCart(t, ck.SessionID)
 	ckjson, _ := json.Marshal(ck)
 
 	req, _ := http.NewRequest("POST", "/checkout", bytes.NewBuffer(ckjson))
@@ -39,3 +83,599 @@ func TestCheckout(t *testing.T) {
 	assert.Equal(t, 200, w.Code)
 	assert.Equal(t, true, match)
 }
+
+func TestSagaCompensation(t *testing.T) {
+	var undone []string
+	step := func(name string, fail bool) sagaStep {
+		return sagaStep{
+			name: name,
+			action: func(s *Saga) error {
+				if fail {
+					return errors.New("step failed")
+				}
+				return nil
+			},
+			compensate: func(s *Saga) error {
+				undone = append(undone, name)
+				return nil
+			},
+		}
+	}
+
+	saga, _ := newSaga(Checkout{SessionID: "sagatest"})
+	err := runSaga(saga, []sagaStep{step("one", false), step("two", false), step("three", true), step("four", false)})
+
+	// The failed step and the ones before it are undone in reverse order
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"three", "two", "one"}, undone)
+
+	var stored Saga
+	db.Where("id = ?", saga.ID).First(&stored)
+	assert.Equal(t, sagaCompensated, stored.Status)
+	assert.Equal(t, "three: step failed", stored.Error)
+
+	// A step that panics fails the saga the same way
+	undone = nil
+	panics := sagaStep{name: "panics", action: func(s *Saga) error { panic("boom") }}
+	saga, _ = newSaga(Checkout{SessionID: "sagapanictest"})
+	err = runSaga(saga, []sagaStep{step("one", false), panics})
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"one"}, undone)
+	assert.Equal(t, sagaCompensated, saga.Status)
+	assert.Equal(t, "panics: panic: boom", saga.Error)
+}
+
+func TestResumeSagas(t *testing.T) {
+	var undone []string
+	steps := []sagaStep{
+		{"one", func(s *Saga) error { return nil }, func(s *Saga) error { undone = append(undone, s.ID); return nil }},
+		{"two", func(s *Saga) error { return nil }, nil},
+	}
+	interrupted := func(sessionid string, heartbeat time.Time) *Saga {
+		saga, _ := newSaga(Checkout{SessionID: sessionid})
+		saga.Owner = "crashed"
+		saga.Step = 1
+		assert.Nil(t, db.Save(saga).Error)
+		assert.Nil(t, db.Model(saga).UpdateColumn("heartbeat_at", heartbeat).Error)
+		return saga
+	}
+
+	// A saga whose owner still renews its lease is left alone, one whose owner stopped is rolled back
+	alive := interrupted("resumealivetest", time.Now())
+	abandoned := interrupted("resumeabandonedtest", time.Now().Add(-2*sagaLease))
+	resumeAbandonedSagas(steps)
+	assert.Equal(t, []string{abandoned.ID}, undone)
+
+	var stored Saga
+	db.Where("id = ?", alive.ID).First(&stored)
+	assert.Equal(t, sagaRunning, stored.Status)
+	assert.Equal(t, "crashed", stored.Owner)
+	var resumed Saga
+	db.Where("id = ?", abandoned.ID).First(&resumed)
+	assert.Equal(t, sagaCompensated, resumed.Status)
+	assert.Equal(t, instanceID, resumed.Owner)
+
+	// And a saga can only be claimed once
+	abandoned = interrupted("resumeclaimtest", time.Now().Add(-2*sagaLease))
+	claimed, err := claimSaga(abandoned)
+	assert.Nil(t, err)
+	assert.True(t, claimed)
+	claimed, err = claimSaga(abandoned)
+	assert.Nil(t, err)
+	assert.False(t, claimed)
+}
+
+func TestIdempotentCheckout(t *testing.T) {
+	router := setupRouter()
+	checkout := func(key string, ck Checkout) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ckjson, _ := json.Marshal(ck)
+		req, _ := http.NewRequest("POST", "/checkout", bytes.NewBuffer(ckjson))
+		req.Header.Set("Idempotency-Key", key)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	ck := Checkout{
+		SessionID:      sessionToken("0d5e7c3a-9b8f-4e21-a6d4-2f1c8b7e5a90"),
+		Address:        "testlane 1",
+		Email:          "test@test.com",
+		CardToken:      cardToken(t, "4432-8015-6152-0454"),
+		ShippingMethod: "standard",
+	}
+	key := "4f9a2c1e-7b3d-4e8a-9c6f-1d2e3f4a5b6c"
+	fillCart(t, ck.SessionID)
+
+	// The duplicate gets the response of the first request
+	first := checkout(key, ck)
+	second := checkout(key, ck)
+	assert.Equal(t, 200, first.Code)
+	assert.Equal(t, 200, second.Code)
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, "true", second.Header().Get("Idempotent-Replayed"))
+
+	// Reusing the key for a different request is refused, also when only the query differs
+	w := httptest.NewRecorder()
+	ckjson, _ := json.Marshal(ck)
+	req, _ := http.NewRequest("POST", "/checkout?async=true", bytes.NewBuffer(ckjson))
+	req.Header.Set("Idempotency-Key", key)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 422, w.Code)
+	ck.Address = "otherlane 2"
+	w = checkout(key, ck)
+	assert.Equal(t, 422, w.Code)
+
+	// A request that panicked can be retried with the same key
+	panics := gin.New()
+	panics.Use(gin.Recovery())
+	panics.POST("/checkout", idempotent, func(c *gin.Context) { panic("boom") })
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/checkout", bytes.NewBufferString(`{}`))
+		req.Header.Set("Idempotency-Key", "panicking-key")
+		panics.ServeHTTP(w, req)
+		assert.Equal(t, 500, w.Code)
+	}
+}
+
+func TestOrders(t *testing.T) {
+	router := setupRouter()
+	w := httptest.NewRecorder()
+
+	ck := Checkout{
+		SessionID:      sessionToken("a3b1c2d4-5e6f-4a7b-8c9d-0e1f2a3b4c5d"),
+		Address:        "orderlane 3",
+		Email:          "orders@test.com",
+		CardToken:      cardToken(t, "4432-8015-6152-0454"),
+		ShippingMethod: "standard",
+	}
+	fillCart(t, ck.SessionID)
+	ckjson, _ := json.Marshal(ck)
+	req, _ := http.NewRequest("POST", "/checkout", bytes.NewBuffer(ckjson))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	var cr struct {
+		OrderID       string `json:"orderid"`
+		TransactionID string `json:"transactionid"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &cr)
+
+	// The order is stored with the references of the checkout
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/order/"+cr.OrderID, nil)
+	router.ServeHTTP(w, req)
+	var order Order
+	_ = json.Unmarshal(w.Body.Bytes(), &order)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "orderlane 3", order.Address)
+	assert.Equal(t, cr.TransactionID, order.TransactionID)
+
+	// With the VAT of every item
+	if assert.Len(t, order.Items, 1) {
+		assert.Equal(t, 21.0, order.Items[0].TaxRate)
+		assert.Equal(t, order.Tax, order.Items[0].Tax)
+		assert.True(t, order.Tax > 0)
+	}
+
+	// And listed under the email address it was placed with, newest first
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/orders?email=orders@test.com&per_page=1", nil)
+	router.ServeHTTP(w, req)
+	var list struct {
+		Orders []Order `json:"orders"`
+		Total  int     `json:"total"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &list)
+	assert.Equal(t, 200, w.Code)
+	assert.Len(t, list.Orders, 1)
+	assert.Equal(t, cr.OrderID, list.Orders[0].ID)
+
+	// Unknown orders are not found
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/order/doesnotexist", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestOrderTransitions(t *testing.T) {
+	router := setupRouter()
+	transition := func(id, status string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/order/"+id+"/transition", bytes.NewBufferString(`{"status": "`+status+`"}`))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	saga, _ := newSaga(Checkout{SessionID: "transitiontest", Email: "transitions@test.com"})
+	saga.TransactionID = "tx"
+	assert.Nil(t, recordOrder(saga))
+
+	// A paid order cannot skip fulfilment
+	w := transition(saga.ID, orderShipped)
+	assert.Equal(t, 409, w.Code)
+	assert.Contains(t, w.Body.String(), "cannot transition an order from paid to shipped")
+
+	// But it can be fulfilled, which is added to its history
+	w = transition(saga.ID, orderFulfilled)
+	var order Order
+	_ = json.Unmarshal(w.Body.Bytes(), &order)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, orderFulfilled, order.Status)
+	assert.Len(t, order.History, 3)
+	assert.Equal(t, orderPaid, order.History[2].From)
+
+	// Unknown statuses and orders are rejected
+	assert.Equal(t, 400, transition(saga.ID, "lost").Code)
+	assert.Equal(t, 404, transition("doesnotexist", orderPaid).Code)
+
+	// Cancelling and refunding go through their own endpoints, which return the money
+	w = transition(saga.ID, orderCancelled)
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "/cancel")
+	w = transition(saga.ID, orderRefunded)
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "/refund")
+}
+
+func TestOrderRefunds(t *testing.T) {
+	router := setupRouter()
+	post := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+	order := func(sessionid string) string {
+		quote, _ := json.Marshal(cart.Quote{
+			Currency: "EUR",
+			Lines: []cart.QuoteLine{
+				{Sku: "A", Name: "Apple", Qty: 2, UnitPrice: 1000, LineTotal: 2000},
+				{Sku: "B", Name: "Banana", Qty: 1, UnitPrice: 500, LineTotal: 500},
+			},
+			Subtotal: 2500,
+		})
+		saga, _ := newSaga(Checkout{SessionID: sessionid, Email: "refunds@test.com"})
+		saga.Quote = string(quote)
+		saga.ShippingCost = 495
+		saga.Total = 2995
+		saga.TransactionID = "tx"
+		saga.ShippingID = "ship"
+		assert.Nil(t, recordOrder(saga))
+		return saga.ID
+	}
+
+	// Part of an order can be refunded
+	id := order("refundtest")
+	w := post("/order/"+id+"/refund", `{"lines": [{"sku": "A", "qty": 1}], "reason": "bruised"}`)
+	var body struct {
+		Refund Refund `json:"refund"`
+		Order  Order  `json:"order"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &body)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 1000, body.Refund.Amount)
+	assert.Equal(t, refundCompleted, body.Refund.Status)
+	assert.NotEmpty(t, body.Refund.PaymentRefundID)
+	assert.Equal(t, orderPaid, body.Order.Status)
+	assert.Equal(t, 1000, body.Order.Refunded)
+	assert.Len(t, body.Order.Refunds, 1)
+
+	// But no more than was ordered, and only products that were
+	assert.Equal(t, 400, post("/order/"+id+"/refund", `{"lines": [{"sku": "A", "qty": 2}]}`).Code)
+	assert.Equal(t, 400, post("/order/"+id+"/refund", `{"lines": [{"sku": "C", "qty": 1}]}`).Code)
+
+	// Refunding the rest refunds the shipping too and closes the order
+	w = post("/order/"+id+"/refund", ``)
+	_ = json.Unmarshal(w.Body.Bytes(), &body)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 1995, body.Refund.Amount)
+	assert.Equal(t, orderRefunded, body.Order.Status)
+	assert.Equal(t, 2995, body.Order.Refunded)
+	assert.Equal(t, 409, post("/order/"+id+"/refund", ``).Code)
+
+	// A paid order can be cancelled, which refunds it completely
+	id = order("canceltest")
+	w = post("/order/"+id+"/cancel", `{"reason": "changed my mind"}`)
+	var cancelled Order
+	_ = json.Unmarshal(w.Body.Bytes(), &cancelled)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, orderCancelled, cancelled.Status)
+	assert.Equal(t, 2995, cancelled.Refunded)
+
+	// But not once it has been shipped
+	id = order("shippedtest")
+	assert.Equal(t, 200, post("/order/"+id+"/transition", `{"status": "fulfilled"}`).Code)
+	assert.Equal(t, 200, post("/order/"+id+"/transition", `{"status": "shipped"}`).Code)
+	w = post("/order/"+id+"/cancel", ``)
+	assert.Equal(t, 409, w.Code)
+	assert.Contains(t, w.Body.String(), "cannot transition an order from shipped to cancelled")
+	assert.Equal(t, 404, post("/order/doesnotexist/cancel", ``).Code)
+
+	// A refund that could not be paid out stays pending and leaves the order open, until it is retried
+	id = order("pendingrefundtest")
+	pending, _ := loadOrder(id)
+	refund, err := refundOrder(pending, nil, "lost")
+	assert.Nil(t, err)
+	db.Model(&Refund{}).Where("id = ?", refund.ID).
+		UpdateColumns(map[string]interface{}{"status": refundPending, "created_at": time.Now().Add(-time.Hour)})
+	retryPendingRefunds(time.Minute)
+	pending, _ = loadOrder(id)
+	assert.Equal(t, orderRefunded, pending.Status)
+	if assert.Len(t, pending.Refunds, 1) {
+		assert.Equal(t, refundCompleted, pending.Refunds[0].Status)
+	}
+}
+
+func TestCheckoutErrors(t *testing.T) {
+	router := setupRouter()
+	checkout := func(ck Checkout) (int, map[string]string) {
+		w := httptest.NewRecorder()
+		ckjson, _ := json.Marshal(ck)
+		req, _ := http.NewRequest("POST", "/checkout", bytes.NewBuffer(ckjson))
+		router.ServeHTTP(w, req)
+		var body map[string]string
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+
+	ck := Checkout{
+		SessionID:      sessionToken("e2f4a6b8-1c3d-4e5f-8a7b-9c0d1e2f3a4b"),
+		Address:        "testlane 1",
+		Email:          "test@test.com",
+		CardToken:      cardToken(t, "4000-0000-0000-0002"),
+		ShippingMethod: "standard",
+	}
+
+	// An empty cart cannot be checked out
+	req, _ := http.NewRequest("DELETE", os.Getenv("CARTSERVICE")+"/cart/"+ck.SessionID, nil)
+	if resp, err := http.DefaultClient.Do(req); assert.Nil(t, err) {
+		resp.Body.Close()
+	}
+	status, body := checkout(ck)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, codeEmptyCart, body["code"])
+	assert.Equal(t, "reserve cart", body["step"])
+
+	// A declined card is reported as such
+	fillCart(t, ck.SessionID)
+	status, body = checkout(ck)
+	assert.Equal(t, 402, status)
+	assert.Equal(t, codePaymentDeclined, body["code"])
+	assert.Equal(t, "payment", body["step"])
+
+	// We only ship with the methods we offer
+	ck.ShippingMethod = "pigeon"
+	status, body = checkout(ck)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, codeShippingMethod, body["code"])
+
+	// To countries we know the VAT of
+	ck.ShippingMethod = "standard"
+	ck.Country = "US"
+	status, body = checkout(ck)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, codeUnknownCountry, body["code"])
+
+	// Cards are paid with by a token the vault knows
+	ck.Country = ""
+	ck.CardToken = "tok_unknown"
+	status, body = checkout(ck)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, codeInvalidCard, body["code"])
+
+	// And never by their number
+	ck.CardToken = "4432 8015 6152 0454"
+	status, body = checkout(ck)
+	assert.Equal(t, 400, status)
+	assert.Equal(t, codeInvalidRequest, body["code"])
+
+	// And a request that is missing fields is rejected
+	status, body = checkout(Checkout{SessionID: ck.SessionID})
+	assert.Equal(t, 400, status)
+	assert.Equal(t, codeInvalidRequest, body["code"])
+}
+
+func TestPriceDrift(t *testing.T) {
+	router := setupRouter()
+	checkout := func(ck Checkout, query string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		ckjson, _ := json.Marshal(ck)
+		req, _ := http.NewRequest("POST", "/checkout"+query, bytes.NewBuffer(ckjson))
+		router.ServeHTTP(w, req)
+		var body map[string]interface{}
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+
+	expected := 1
+	ck := Checkout{
+		SessionID:      sessionToken("5a6b7c8d-9e0f-4a1b-8c2d-3e4f5a6b7c8d"),
+		Address:        "testlane 1",
+		Email:          "test@test.com",
+		CardToken:      cardToken(t, "4432-8015-6152-0454"),
+		ShippingMethod: "standard",
+		ExpectedTotal:  &expected,
+	}
+	fillCart(t, ck.SessionID)
+
+	// A checkout that costs something else than the user saw is refused with what it costs now
+	status, body := checkout(ck, "")
+	assert.Equal(t, 409, status)
+	assert.Equal(t, codePriceChanged, body["code"])
+	assert.Equal(t, float64(1), body["expected_total"])
+	quote, _ := body["quote"].(map[string]interface{})
+	total, _ := quote["total"].(float64)
+	assert.NotZero(t, total)
+
+	// Also when it is checked out asynchronously
+	status, body = checkout(ck, "?async=true")
+	assert.Equal(t, 409, status)
+	assert.Equal(t, codePriceChanged, body["code"])
+
+	// But it goes through for the current total
+	expected = int(total)
+	status, body = checkout(ck, "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, total, body["total"])
+}
+
+func TestQuotedTotalIsCharged(t *testing.T) {
+	router := setupRouter()
+	defer func(rules tax.Rules) { taxRules = rules }(taxRules)
+	taxRules = tax.Rules{Mode: tax.Exclusive, Rates: tax.DefaultRules.Rates}
+
+	sessionid := sessionToken("c4d5e6f7-a8b9-4c0d-9e1f-2a3b4c5d6e7f")
+	fillCart(t, sessionid)
+
+	// The quote of the cart page adds the VAT on top of the prices
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/shipping/quote?country=NL&sessionid="+sessionid, nil)
+	router.ServeHTTP(w, req)
+	var quote struct {
+		Methods []rates.Option `json:"methods"`
+		Tax     int            `json:"tax"`
+		Total   int            `json:"total"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &quote)
+	assert.Equal(t, 200, w.Code)
+
+	// And with shipping that is exactly what checkout charges
+	expected := quote.Total
+	for _, m := range quote.Methods {
+		if m.Method == "standard" {
+			expected += m.Price
+		}
+	}
+	ck := Checkout{
+		SessionID:      sessionid,
+		Address:        "testlane 1",
+		Email:          "test@test.com",
+		CardToken:      cardToken(t, "4432-8015-6152-0454"),
+		ShippingMethod: "standard",
+		ExpectedTotal:  &expected,
+	}
+	w = httptest.NewRecorder()
+	ckjson, _ := json.Marshal(ck)
+	req, _ = http.NewRequest("POST", "/checkout", bytes.NewBuffer(ckjson))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestMaskCardNumbers(t *testing.T) {
+	assert.Equal(t, "paid with ************0454", maskCardNumbers("paid with 4432-8015-6152-0454"))
+	assert.Equal(t, "paid with ************0454", maskCardNumbers("paid with 4432801561520454"))
+
+	// Numbers that are no card numbers are left alone
+	assert.Equal(t, "order 1234567890123", maskCardNumbers("order 1234567890123"))
+	assert.Equal(t, "shipment 11111111-1111-1111-1111-111111111111", maskCardNumbers("shipment 11111111-1111-1111-1111-111111111111"))
+}
+
+func TestShippingQuote(t *testing.T) {
+	router := setupRouter()
+	sessionid := sessionToken("b7c8d9e0-f1a2-4b3c-8d4e-5f6a7b8c9d0e")
+	fillCart(t, sessionid)
+
+	// Both methods ship to the Netherlands
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/shipping/quote?country=NL&sessionid="+sessionid, nil)
+	router.ServeHTTP(w, req)
+	var quote struct {
+		Methods []rates.Option `json:"methods"`
+		Tax     int            `json:"tax"`
+		Total   int            `json:"total"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &quote)
+	assert.Equal(t, 200, w.Code)
+	assert.Len(t, quote.Methods, 2)
+
+	// With the VAT on the cart in the Netherlands, which is included in the prices
+	assert.True(t, quote.Tax > 0)
+	assert.True(t, quote.Total > quote.Tax)
+
+	// But nothing ships to countries we do not know
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/shipping/quote?country=US&sessionid="+sessionid, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+
+	// Or when a country has no VAT rate for a product
+	defer func(rules tax.Rules) { taxRules = rules }(taxRules)
+	taxRules = tax.Rules{Mode: tax.Inclusive, Rates: map[string]map[string]float64{"NL": {tax.Reduced: 9}}}
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/shipping/quote?country=NL&sessionid="+sessionid, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), codeUnknownTaxClass)
+}
+
+func TestAsyncCheckout(t *testing.T) {
+	router := setupRouter()
+	checkout := func(ck Checkout) CheckoutStatus {
+		w := httptest.NewRecorder()
+		ckjson, _ := json.Marshal(ck)
+		req, _ := http.NewRequest("POST", "/checkout?async=true", bytes.NewBuffer(ckjson))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 202, w.Code)
+		location := w.Header().Get("Location")
+
+		// Poll the status until the checkout is done
+		var status CheckoutStatus
+		for i := 0; i < 100 && !status.done(); i++ {
+			time.Sleep(100 * time.Millisecond)
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("GET", location, nil)
+			router.ServeHTTP(w, req)
+			assert.Equal(t, 200, w.Code)
+			_ = json.Unmarshal(w.Body.Bytes(), &status)
+		}
+		return status
+	}
+
+	ck := Checkout{
+		SessionID:      sessionToken("3f9e2d1c-8b7a-4c6d-9e5f-0a1b2c3d4e5f"),
+		Address:        "testlane 1",
+		Email:          "test@test.com",
+		CardToken:      cardToken(t, "4432-8015-6152-0454"),
+		ShippingMethod: "standard",
+	}
+	fillCart(t, ck.SessionID)
+
+	// The checkout completes in the background and empties the cart
+	status := checkout(ck)
+	assert.Equal(t, sagaCompleted, status.Status)
+	assert.Equal(t, len(checkoutSteps), status.Completed)
+	assert.NotEmpty(t, status.ShippingID)
+	assert.NotEmpty(t, status.TransactionID)
+	resp, err := http.Get(os.Getenv("CARTSERVICE") + "/cart/" + ck.SessionID)
+	if assert.Nil(t, err) {
+		var cart struct {
+			Items []interface{} `json:"items"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&cart)
+		resp.Body.Close()
+		assert.Empty(t, cart.Items)
+	}
+
+	// The event stream of a finished checkout sends its status and ends
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/checkout/"+status.ID+"/events", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "event:status")
+	assert.Contains(t, w.Body.String(), `"status":"completed"`)
+
+	// A failed checkout reports why and where it failed
+	fillCart(t, ck.SessionID)
+	ck.CardToken = cardToken(t, "4000-0000-0000-0002")
+	status = checkout(ck)
+	assert.Equal(t, sagaCompensated, status.Status)
+	assert.Equal(t, codePaymentDeclined, status.Code)
+	assert.Equal(t, "payment", status.Step)
+
+	// And unknown checkouts do not exist
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/checkout/unknown/status", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+}
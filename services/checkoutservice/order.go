@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+// The default and maximum number of orders listed per page
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// Order is a completed checkout. All amounts are in cents, as charged.
+type Order struct {
+	ID             string            `json:"id" gorm:"primary_key"`
+	Email          string            `json:"email" gorm:"index"`
+	Address        string            `json:"address"`
+	Country        string            `json:"country"`
+	Currency       string            `json:"currency"`
+	Status         string            `json:"status"`
+	Items          []OrderItem       `json:"items"`
+	Subtotal       int               `json:"subtotal"`
+	Discount       int               `json:"discount"`
+	TaxMode        string            `json:"tax_mode"`
+	Tax            int               `json:"tax"`
+	ShippingMethod string            `json:"shipping_method"`
+	ShippingCost   int               `json:"shipping_cost"`
+	Total          int               `json:"total"`
+	Refunded       int               `json:"refunded"`
+	TransactionID  string            `json:"transactionid"`
+	ShippingID     string            `json:"shippingid"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+	History        []OrderTransition `json:"history,omitempty"`
+	Refunds        []Refund          `json:"refunds,omitempty"`
+}
+
+// OrderItem is a single product of an Order, with the price it was sold at.
+type OrderItem struct {
+	ID        uint   `json:"-" gorm:"primary_key"`
+	OrderID   string `json:"-" gorm:"index"`
+	Sku       string `json:"sku"`
+	Name      string `json:"name"`
+	Qty       int    `json:"qty"`
+	UnitPrice int    `json:"unit_price"`
+	LineTotal int    `json:"line_total"`
+
+	// The VAT on the item after discounts, at a rate in percent
+	TaxClass string  `json:"tax_class"`
+	TaxRate  float64 `json:"tax_rate"`
+	Tax      int     `json:"tax"`
+
+	// How many of the item have been refunded
+	RefundedQty int `json:"refunded_qty"`
+}
+
+// recordOrder stores the order of a checkout, which has been paid for by now. The order has the ID of its saga,
+// so recording it twice leaves a single order.
+func recordOrder(s *Saga) error {
+	quote, breakdown := s.quote(), s.tax()
+	order := Order{
+		ID:             s.ID,
+		Status:         orderPaid,
+		Email:          s.Email,
+		Address:        s.Address,
+		Country:        s.Country,
+		Currency:       quote.Currency,
+		Subtotal:       quote.Subtotal,
+		Discount:       quote.Discount,
+		TaxMode:        breakdown.Mode,
+		Tax:            breakdown.Tax,
+		ShippingMethod: s.ShippingMethod,
+		ShippingCost:   s.ShippingCost,
+		Total:          s.Total,
+		TransactionID:  s.TransactionID,
+		ShippingID:     s.ShippingID,
+	}
+	for n, l := range quote.Lines {
+		item := OrderItem{
+			OrderID:   s.ID,
+			Sku:       l.Sku,
+			Name:      l.Name,
+			Qty:       l.Qty,
+			UnitPrice: l.UnitPrice,
+			LineTotal: l.LineTotal,
+		}
+		if n < len(breakdown.Lines) {
+			item.TaxClass = breakdown.Lines[n].Class
+			item.TaxRate = breakdown.Lines[n].Rate
+			item.Tax = breakdown.Lines[n].Tax
+		}
+		order.Items = append(order.Items, item)
+	}
+
+	order.History = []OrderTransition{
+		{OrderID: s.ID, To: orderPending, Reason: "order placed"},
+		{OrderID: s.ID, From: orderPending, To: orderPaid, Reason: "transaction " + s.TransactionID},
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var count int
+		if err := tx.Model(&Order{}).Where("id = ?", s.ID).Count(&count).Error; err != nil || count > 0 {
+			return err
+		}
+		return tx.Create(&order).Error
+	})
+}
+
+// deleteOrder removes the order of a checkout that is being rolled back.
+func deleteOrder(s *Saga) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("order_id = ?", s.ID).Delete(OrderItem{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("order_id = ?", s.ID).Delete(OrderTransition{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", s.ID).Delete(Order{}).Error
+	})
+}
+
+// getOrder returns a single order as JSON.
+func getOrder(c *gin.Context) {
+
+	// Get the order ID
+	id := c.Param("id")
+
+	// Check if there is an order with this ID in the database
+	order, err := loadOrder(id)
+	if err == errOrderNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"order": id,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Return the order
+	c.JSON(http.StatusOK, order)
+}
+
+// getOrders returns the orders placed with ?email=, newest first. The orders are paginated with ?page=,
+// starting at 1, and ?per_page=.
+func getOrders(c *gin.Context) {
+
+	// Get the email address and the page to return
+	email := c.Query("email")
+	if email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "email is required",
+		})
+		return
+	}
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "page must be a positive number",
+		})
+		return
+	}
+	perPage, err := strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(defaultPerPage)))
+	if err != nil || perPage < 1 || perPage > maxPerPage {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "per_page must be between 1 and " + strconv.Itoa(maxPerPage),
+		})
+		return
+	}
+
+	// Count and fetch the orders on the requested page
+	var count int
+	orders := []Order{}
+	query := db.Model(&Order{}).Where("email = ?", email)
+	err = query.Count(&count).Error
+	if err == nil {
+		err = query.Preload("Items").Order("created_at desc").Offset((page - 1) * perPage).Limit(perPage).Find(&orders).Error
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"email": email,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Return the orders
+	c.JSON(http.StatusOK, gin.H{
+		"orders":   orders,
+		"page":     page,
+		"per_page": perPage,
+		"total":    count,
+	})
+}
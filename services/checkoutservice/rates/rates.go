@@ -0,0 +1,144 @@
+// Package rates calculates what shipping an order costs with every shipping method, from rate tables
+// per destination zone.
+package rates
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// The shipping methods we offer by default
+const (
+	Standard = "standard"
+	Express  = "express"
+)
+
+// Bracket is the price of shipping parcels up to a weight in grams. A MaxWeight of 0 has no limit.
+type Bracket struct {
+	MaxWeight int `json:"max_weight"`
+	Price     int `json:"price"`
+}
+
+// Method is a way of shipping to a zone, with its price per weight bracket in ascending order of weight.
+// Orders worth at least FreeFrom cents are shipped for free, a FreeFrom of 0 means never.
+type Method struct {
+	Name     string    `json:"name"`
+	Zone     string    `json:"zone"`
+	MinDays  int       `json:"min_days"`
+	MaxDays  int       `json:"max_days"`
+	Brackets []Bracket `json:"brackets"`
+	FreeFrom int       `json:"free_from"`
+}
+
+// Table holds the zone of every country we ship to and the shipping methods of every zone.
+type Table struct {
+	Zones   map[string]string `json:"zones"`
+	Methods []Method          `json:"methods"`
+}
+
+// DefaultTable ships within the Netherlands and to our neighbours.
+var DefaultTable = Table{
+	Zones: map[string]string{
+		"NL": "domestic",
+		"BE": "eu",
+		"DE": "eu",
+	},
+	Methods: []Method{
+		{Standard, "domestic", 1, 2, []Bracket{{2000, 495}, {10000, 695}, {30000, 1295}}, 5000},
+		{Express, "domestic", 1, 1, []Bracket{{2000, 995}, {10000, 1295}, {30000, 1995}}, 0},
+		{Standard, "eu", 2, 5, []Bracket{{2000, 895}, {10000, 1395}, {30000, 2495}}, 10000},
+		{Express, "eu", 1, 2, []Bracket{{2000, 1995}, {10000, 2995}}, 0},
+	},
+}
+
+// Parse reads a rate table from JSON in the form of DefaultTable.
+func Parse(data []byte) (Table, error) {
+	var table Table
+	if err := json.Unmarshal(data, &table); err != nil {
+		return Table{}, err
+	}
+	for _, m := range table.Methods {
+		if m.Name == "" || m.Zone == "" || len(m.Brackets) == 0 {
+			return Table{}, fmt.Errorf("every shipping method needs a name, a zone and at least one bracket")
+		}
+	}
+	return table, nil
+}
+
+// UnknownCountryError is returned when we do not ship to a country.
+type UnknownCountryError struct {
+	Country string
+}
+
+func (e *UnknownCountryError) Error() string {
+	return fmt.Sprintf("we do not ship to %v", e.Country)
+}
+
+// UnavailableError is returned when an order cannot be shipped with a method.
+type UnavailableError struct {
+	Method string
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("shipping method %v is not available for this order", e.Method)
+}
+
+// Option is a shipping method an order can be shipped with, and what it costs.
+type Option struct {
+	Method  string `json:"method"`
+	Price   int    `json:"price"`
+	Free    bool   `json:"free"`
+	MinDays int    `json:"min_days"`
+	MaxDays int    `json:"max_days"`
+}
+
+// Options returns the shipping methods an order of a total weight in grams and worth value cents can be shipped
+// to a country with. Standard shipping is free when freeStandard is set, for example by a coupon.
+func (t Table) Options(country string, weight, value int, freeStandard bool) ([]Option, error) {
+	zone, ok := t.Zones[country]
+	if !ok {
+		return nil, &UnknownCountryError{country}
+	}
+
+	options := []Option{}
+	for _, m := range t.Methods {
+		if m.Zone != zone {
+			continue
+		}
+		price, ok := m.price(weight)
+		if !ok {
+			continue
+		}
+		o := Option{Method: m.Name, Price: price, MinDays: m.MinDays, MaxDays: m.MaxDays}
+		if (m.FreeFrom > 0 && value >= m.FreeFrom) || (freeStandard && m.Name == Standard) {
+			o.Price = 0
+			o.Free = true
+		}
+		options = append(options, o)
+	}
+	return options, nil
+}
+
+// Option returns what shipping an order with the given method costs. See Options.
+func (t Table) Option(country, method string, weight, value int, freeStandard bool) (Option, error) {
+	options, err := t.Options(country, weight, value, freeStandard)
+	if err != nil {
+		return Option{}, err
+	}
+	for _, o := range options {
+		if o.Method == method {
+			return o, nil
+		}
+	}
+	return Option{}, &UnavailableError{method}
+}
+
+// price returns the price of shipping a weight with the method, or false if it is too heavy.
+func (m Method) price(weight int) (int, bool) {
+	for _, b := range m.Brackets {
+		if b.MaxWeight == 0 || weight <= b.MaxWeight {
+			return b.Price, true
+		}
+	}
+	return 0, false
+}
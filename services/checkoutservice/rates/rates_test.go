@@ -0,0 +1,39 @@
+package rates
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptions(t *testing.T) {
+	options, err := DefaultTable.Options("NL", 1500, 2000, false)
+
+	// Both methods are offered at the price of the lightest bracket
+	assert.Nil(t, err)
+	assert.Equal(t, []Option{
+		{Method: Standard, Price: 495, MinDays: 1, MaxDays: 2},
+		{Method: Express, Price: 995, MinDays: 1, MaxDays: 1},
+	}, options)
+}
+
+func TestFreeShipping(t *testing.T) {
+	// Above the threshold standard shipping is free, express is not
+	o, _ := DefaultTable.Option("NL", Standard, 1500, 5000, false)
+	assert.True(t, o.Free)
+	o, _ = DefaultTable.Option("NL", Express, 1500, 5000, false)
+	assert.Equal(t, 995, o.Price)
+
+	// A coupon makes standard shipping free as well
+	o, _ = DefaultTable.Option("DE", Standard, 1500, 100, true)
+	assert.Equal(t, 0, o.Price)
+}
+
+func TestUnavailable(t *testing.T) {
+	// Express does not take heavy parcels abroad
+	_, err := DefaultTable.Option("BE", Express, 20000, 100, false)
+	assert.IsType(t, &UnavailableError{}, err)
+
+	_, err = DefaultTable.Options("US", 100, 100, false)
+	assert.IsType(t, &UnknownCountryError{}, err)
+}
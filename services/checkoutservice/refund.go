@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/clients/rest"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/mail"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/tax"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+// The statuses of a refund. A pending refund has been recorded, but not paid out yet.
+const (
+	refundPending   = "pending"
+	refundCompleted = "completed"
+)
+
+// refundRetryInterval is how often refunds that are still pending are paid out again
+const refundRetryInterval = time.Minute
+
+// Refund records money that was returned to the customer for an order. Amount is in cents.
+type Refund struct {
+	ID              string       `json:"id" gorm:"primary_key"`
+	OrderID         string       `json:"-" gorm:"index"`
+	Status          string       `json:"status" gorm:"index"`
+	Amount          int          `json:"amount"`
+	Reason          string       `json:"reason,omitempty"`
+	Lines           []RefundLine `json:"lines"`
+	PaymentRefundID string       `json:"payment_refund_id"`
+	CreatedAt       time.Time    `json:"created_at"`
+}
+
+// RefundLine is the quantity of a single product of an order that is refunded.
+type RefundLine struct {
+	ID       uint   `json:"-" gorm:"primary_key"`
+	RefundID string `json:"-" gorm:"index"`
+	Sku      string `json:"sku"`
+	Qty      int    `json:"qty"`
+}
+
+// errNothingToRefund is returned when everything of an order has been refunded already.
+var errNothingToRefund = errors.New("everything of this order has been refunded already")
+
+// RefundError is returned when a refund asks for products the order does not have, or has been refunded already.
+type RefundError struct {
+	Message string
+}
+
+func (e *RefundError) Error() string {
+	return e.Message
+}
+
+// paidFor returns what was paid for an item of the order: its share of the discount is taken off and VAT that
+// was added on top of the prices is added.
+func (o Order) paidFor(item OrderItem) int {
+	paid := item.LineTotal
+	if o.Subtotal > 0 {
+		paid -= o.Discount * item.LineTotal / o.Subtotal
+	}
+	if o.TaxMode == tax.Exclusive {
+		paid += item.Tax
+	}
+	return paid
+}
+
+// refundsPending reports whether the order has refunds that have not been paid out yet.
+func (o Order) refundsPending() bool {
+	for _, r := range o.Refunds {
+		if r.Status == refundPending {
+			return true
+		}
+	}
+	return false
+}
+
+// fullyRefunded reports whether every item of the order has been refunded.
+func (o Order) fullyRefunded() bool {
+	for _, i := range o.Items {
+		if i.RefundedQty < i.Qty {
+			return false
+		}
+	}
+	return true
+}
+
+// refundOrder refunds the given quantities of the products of an order, or everything that has not been refunded
+// yet when there are no lines. The refund that empties the order also refunds the shipping costs and whatever
+// rounding left, so an order is never refunded more or less than was paid for it.
+// The refund is recorded as pending before it is paid out. When the payment service cannot tell whether it
+// paid out, the refund stays pending and retryRefunds pays it out later.
+func refundOrder(order Order, lines []RefundLine, reason string) (Refund, error) {
+
+	// Work out what to refund
+	items := make(map[string]OrderItem)
+	for _, i := range order.Items {
+		items[i.Sku] = i
+	}
+	if len(lines) == 0 {
+		for _, i := range order.Items {
+			if left := i.Qty - i.RefundedQty; left > 0 {
+				lines = append(lines, RefundLine{Sku: i.Sku, Qty: left})
+			}
+		}
+	}
+	requested := make(map[string]int)
+	var amount int
+	for _, l := range lines {
+		item, ok := items[l.Sku]
+		if !ok {
+			return Refund{}, &RefundError{fmt.Sprintf("the order has no product %v", l.Sku)}
+		}
+		requested[l.Sku] += l.Qty
+		if l.Qty < 1 || requested[l.Sku] > item.Qty-item.RefundedQty {
+			return Refund{}, &RefundError{fmt.Sprintf("%v of product %v can be refunded", item.Qty-item.RefundedQty, l.Sku)}
+		}
+		amount += order.paidFor(item) * l.Qty / item.Qty
+	}
+	left := 0
+	for _, i := range order.Items {
+		left += i.Qty - i.RefundedQty - requested[i.Sku]
+	}
+	if left == 0 {
+		amount = order.Total - order.Refunded
+	}
+	if amount <= 0 {
+		return Refund{}, errNothingToRefund
+	}
+
+	// Claim the products before paying out, so two refunds can never refund the same products
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return Refund{}, err
+	}
+	refund := Refund{
+		ID:      hex.EncodeToString(b),
+		OrderID: order.ID,
+		Status:  refundPending,
+		Amount:  amount,
+		Reason:  reason,
+		Lines:   lines,
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, l := range lines {
+			result := tx.Model(&OrderItem{}).Where("order_id = ? AND sku = ? AND refunded_qty + ? <= qty", order.ID, l.Sku, l.Qty).
+				UpdateColumn("refunded_qty", gorm.Expr("refunded_qty + ?", l.Qty))
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errOrderChanged
+			}
+		}
+		result := tx.Model(&Order{}).Where("id = ? AND refunded + ? <= total", order.ID, amount).
+			UpdateColumn("refunded", gorm.Expr("refunded + ?", amount))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errOrderChanged
+		}
+		return tx.Create(&refund).Error
+	})
+	if err != nil {
+		return Refund{}, err
+	}
+
+	// Pay out
+	if err := payOutRefund(&refund, order.TransactionID); err != nil && !refundRefused(err) {
+		log.WithFields(log.Fields{
+			"order":  order.ID,
+			"refund": refund.ID,
+		}).Warn(err)
+	} else if err != nil {
+		return Refund{}, err
+	}
+	return refund, nil
+}
+
+// refundRefused reports whether the payment service refused to pay out a refund, rather than that we do not
+// know whether it did.
+func refundRefused(err error) bool {
+	e, ok := err.(*rest.Error)
+	return ok && e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// payOutRefund pays out a pending refund of the charge with the given transaction ID and marks it completed.
+// The refund is its own reference at the payment service, so paying it out again never pays twice.
+// A refund the payment service refuses is undone, which gives its products back to the order.
+func payOutRefund(refund *Refund, transactionID string) error {
+	paymentRefundID, err := payments.RefundAmount(context.Background(), transactionID, refund.Amount, refund.ID)
+	if refundRefused(err) {
+		if err := undoRefund(*refund); err != nil {
+			log.WithFields(log.Fields{
+				"order":  refund.OrderID,
+				"refund": refund.ID,
+			}).Error(err)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	refund.Status = refundCompleted
+	refund.PaymentRefundID = paymentRefundID
+	err = db.Model(&Refund{}).Where("id = ?", refund.ID).Updates(map[string]interface{}{
+		"status":            refundCompleted,
+		"payment_refund_id": paymentRefundID,
+	}).Error
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"order":  refund.OrderID,
+		"refund": refund.ID,
+		"amount": refund.Amount,
+	}).Info("Refunded order")
+	return nil
+}
+
+// finishRefund closes an order once all of it has been paid back, and emails the customer what was refunded.
+// It is only called for refunds that have been paid out, so nobody is told about money they did not get back.
+func finishRefund(refund Refund) (Order, error) {
+	order, err := loadOrder(refund.OrderID)
+	if err != nil {
+		return order, err
+	}
+	if order.fullyRefunded() && !order.refundsPending() && canTransition(order.Status, orderRefunded) {
+		order, err = transitionOrder(order.ID, orderRefunded, refund.Reason)
+		if err != nil {
+			return order, err
+		}
+	}
+	notifyRefund(order, refund, order.Status == orderCancelled)
+	return order, nil
+}
+
+// retryRefunds pays out the refunds that are still pending every interval, for as long as the service runs.
+func retryRefunds(interval time.Duration) {
+	for {
+		retryPendingRefunds(interval)
+		time.Sleep(interval)
+	}
+}
+
+// retryPendingRefunds pays out the refunds that have been pending for longer than age, so one that is being
+// paid out right now is left alone. Refunds that are paid out finish their order like postRefund does.
+func retryPendingRefunds(age time.Duration) {
+	var refunds []Refund
+	err := db.Preload("Lines").Where("status = ? AND created_at < ?", refundPending, time.Now().Add(-age)).
+		Find(&refunds).Error
+	if err != nil {
+		log.Errorf("Could not load pending refunds: %v", err)
+		return
+	}
+	for i := range refunds {
+		refund := &refunds[i]
+		var order Order
+		err := db.Where("id = ?", refund.OrderID).First(&order).Error
+		if err == nil {
+			err = payOutRefund(refund, order.TransactionID)
+		}
+		if err == nil {
+			_, err = finishRefund(*refund)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"order":  refund.OrderID,
+				"refund": refund.ID,
+			}).Error(err)
+		}
+	}
+}
+
+// undoRefund gives the products of a refund that could not be paid out back to its order. A refund that is
+// no longer pending, or was undone already, is left alone.
+func undoRefund(refund Refund) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ? AND status = ?", refund.ID, refundPending).Delete(Refund{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		for _, l := range refund.Lines {
+			err := tx.Model(&OrderItem{}).Where("order_id = ? AND sku = ?", refund.OrderID, l.Sku).
+				UpdateColumn("refunded_qty", gorm.Expr("refunded_qty - ?", l.Qty)).Error
+			if err != nil {
+				return err
+			}
+		}
+		err := tx.Model(&Order{}).Where("id = ?", refund.OrderID).
+			UpdateColumn("refunded", gorm.Expr("refunded - ?", refund.Amount)).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("refund_id = ?", refund.ID).Delete(RefundLine{}).Error
+	})
+}
+
+// notifyRefund emails the customer what was refunded, and whether their order was cancelled. The refund has
+// happened either way, so failing to send it is only logged.
+func notifyRefund(order Order, refund Refund, cancelled bool) {
+	names := make(map[string]string)
+	for _, i := range order.Items {
+		names[i.Sku] = i.Name
+	}
+	notice := mail.RefundNotice{
+		OrderID:   order.ID,
+		Email:     order.Email,
+		Currency:  order.Currency,
+		Amount:    refund.Amount,
+		Reason:    refund.Reason,
+		Cancelled: cancelled,
+	}
+	for _, l := range refund.Lines {
+		notice.Lines = append(notice.Lines, mail.Line{Sku: l.Sku, Name: names[l.Sku], Qty: l.Qty})
+	}
+
+	m, err := mail.RenderRefund(mailFrom, notice)
+	if err == nil {
+		err = emails.Send(context.Background(), m)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"order": order.ID,
+		}).Warn(err)
+	}
+}
+
+// postCancel cancels an order that has not been shipped yet. The shipment is cancelled, whatever was paid and
+// not refunded yet is refunded and the customer is emailed. Cancelling an order that was partly done before
+// finishes it, so a failed cancellation can simply be tried again.
+func postCancel(c *gin.Context) {
+
+	// Get the order ID and the reason
+	id := c.Param("id")
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if body.Reason == "" {
+		body.Reason = "cancelled on request"
+	}
+
+	// Check the order can still be cancelled
+	order, err := loadOrder(id)
+	if err == nil && !canTransition(order.Status, orderCancelled) {
+		err = &IllegalTransitionError{order.Status, orderCancelled, orderTransitions[order.Status]}
+	}
+	if err != nil {
+		abortWithOrderError(c, id, err)
+		return
+	}
+
+	// Stop the shipment first, so nothing is shipped that is no longer paid for
+	if err := shipments.Cancel(context.Background(), order.ShippingID, order.ID); err != nil {
+		abortWithOrderError(c, id, err)
+		return
+	}
+
+	// Then refund the payment and close the order
+	refund, err := refundOrder(order, nil, body.Reason)
+	refunded := err == nil && refund.Status == refundCompleted
+	if err != nil && err != errNothingToRefund {
+		abortWithOrderError(c, id, err)
+		return
+	}
+	order, err = transitionOrder(id, orderCancelled, body.Reason)
+	if err != nil {
+		abortWithOrderError(c, id, err)
+		return
+	}
+	// A refund that is still being paid out is emailed by retryRefunds once it is
+	if refunded {
+		notifyRefund(order, refund, true)
+	}
+
+	// Return the cancelled order
+	c.JSON(http.StatusOK, order)
+}
+
+// postRefund refunds the quantities of the products of an order in the request body, or the whole order when
+// the body has no lines, and emails the customer. An order that has been refunded completely becomes refunded.
+func postRefund(c *gin.Context) {
+
+	// Get the order ID and what to refund
+	id := c.Param("id")
+	var body struct {
+		Lines  []RefundLine `json:"lines"`
+		Reason string       `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Check the order can be refunded
+	order, err := loadOrder(id)
+	if err == nil && !canTransition(order.Status, orderRefunded) {
+		err = &IllegalTransitionError{order.Status, orderRefunded, orderTransitions[order.Status]}
+	}
+	if err != nil {
+		abortWithOrderError(c, id, err)
+		return
+	}
+
+	// Refund it. A refund that is still being paid out is accepted, and finished when retryRefunds pays it out.
+	refund, err := refundOrder(order, body.Lines, body.Reason)
+	status := http.StatusOK
+	if err == nil && refund.Status == refundCompleted {
+		order, err = finishRefund(refund)
+	} else if err == nil {
+		status = http.StatusAccepted
+		order, err = loadOrder(id)
+	}
+	if err != nil {
+		abortWithOrderError(c, id, err)
+		return
+	}
+
+	// Return the refund and the order it was made for
+	c.JSON(status, gin.H{
+		"refund": refund,
+		"order":  order,
+	})
+}
+
+// abortWithOrderError answers a request for an order with err.
+func abortWithOrderError(c *gin.Context, id string, err error) {
+	if illegal, ok := err.(*IllegalTransitionError); ok {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error":   illegal.Error(),
+			"status":  illegal.From,
+			"allowed": illegal.Allowed,
+		})
+		return
+	}
+	if refundErr, ok := err.(*RefundError); ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": refundErr.Error(),
+		})
+		return
+	}
+	switch err {
+	case errOrderNotFound:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+	case errOrderChanged, errNothingToRefund:
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+	default:
+		log.WithFields(log.Fields{
+			"order": id,
+		}).Error(err)
+		abortWithError(c, err)
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/clients/cart"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/clients/shipping"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/mail"
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/tax"
+	log "github.com/sirupsen/logrus"
+)
+
+// The states a saga can be in
+const (
+	sagaRunning      = "running"
+	sagaCompleted    = "completed"
+	sagaCompensating = "compensating"
+	sagaCompensated  = "compensated"
+)
+
+// Sagas are owned by the instance running them, which keeps renewing its lease on them every sagaHeartbeat.
+// Another instance only takes over a saga once its lease ran out for sagaLease.
+const (
+	sagaHeartbeat = 10 * time.Second
+	sagaLease     = time.Minute
+)
+
+// instanceID identifies this instance of the service as the owner of the sagas it runs
+var instanceID = func() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}()
+
+// Saga is the persisted state of a single checkout. Every step that has been completed is recorded before
+// the next one starts, so an interrupted checkout can be finished or rolled back after a crash.
+type Saga struct {
+	ID             string `gorm:"primary_key"`
+	SessionID      string
+	Address        string
+	Country        string
+	ShippingMethod string
+	ShippingCost   int
+	ExpectedTotal  *int
+	Email          string
+	Snapshot       string
+	Quote          string `gorm:"type:text"`
+	Tax            string `gorm:"type:text"`
+	Total          int
+	TransactionID  string
+	ShippingID     string
+	Step           int
+	Status         string `gorm:"index"`
+	FailedStep     string
+	Error          string
+	Code           string
+	Owner          string
+	HeartbeatAt    time.Time `gorm:"index"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+
+	// CardToken is only kept in memory, so a saga that crashed before paying can never pay afterwards
+	CardToken string `gorm:"-"`
+}
+
+// sagaStep is a single step of the checkout. compensate undoes action and is nil if there is nothing to undo.
+// Both must be safe to run more than once, as a crash can happen right after either of them.
+type sagaStep struct {
+	name       string
+	action     func(s *Saga) error
+	compensate func(s *Saga) error
+}
+
+// checkoutSteps are the steps of a checkout, in order
+var checkoutSteps = []sagaStep{
+	{"reserve cart", reserveCart, releaseCart},
+	{"payment", chargePayment, refundCharge},
+	{"shipping", createShipment, cancelShipment},
+	{"record order", recordOrder, deleteOrder},
+	{"confirmation email", sendConfirmation, nil},
+	{"empty cart", emptyCart, nil},
+}
+
+// stepPayment is the index of the payment step. Sagas that crashed before it completed are rolled back,
+// sagas that crashed after it are finished.
+const stepPayment = 1
+
+// newSaga creates a saga for a checkout.
+func newSaga(checkout Checkout) (*Saga, error) {
+	country := checkout.Country
+	if country == "" {
+		country = "NL"
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &Saga{
+		ID:             hex.EncodeToString(b),
+		SessionID:      checkout.SessionID,
+		Address:        checkout.Address,
+		Country:        country,
+		ShippingMethod: checkout.ShippingMethod,
+		ExpectedTotal:  checkout.ExpectedTotal,
+		Email:          checkout.Email,
+		CardToken:      checkout.CardToken,
+		Status:         sagaRunning,
+		Owner:          instanceID,
+	}, nil
+}
+
+// quote returns the priced cart the saga is checking out.
+func (s *Saga) quote() cart.Quote {
+	var quote cart.Quote
+	json.Unmarshal([]byte(s.Quote), &quote)
+	return quote
+}
+
+// tax returns the VAT breakdown of what the saga is checking out.
+func (s *Saga) tax() tax.Breakdown {
+	var breakdown tax.Breakdown
+	json.Unmarshal([]byte(s.Tax), &breakdown)
+	return breakdown
+}
+
+// priceQuote returns what the saga is checking out and what it costs.
+func (s *Saga) priceQuote() PriceQuote {
+	quote := s.quote()
+	return PriceQuote{
+		Currency:     quote.Currency,
+		Lines:        quote.Lines,
+		Subtotal:     quote.Subtotal,
+		Discount:     quote.Discount,
+		ShippingCost: s.ShippingCost,
+		Tax:          s.tax().Tax,
+		Total:        s.Total,
+	}
+}
+
+// items returns the items the saga is checking out.
+func (s *Saga) items() []shipping.Item {
+	var items []shipping.Item
+	for _, l := range s.quote().Lines {
+		items = append(items, shipping.Item{Sku: l.Sku, Qty: l.Qty})
+	}
+	return items
+}
+
+// confirmation returns what the order confirmation of the saga tells the user.
+func (s *Saga) confirmation() mail.Confirmation {
+	quote := s.quote()
+	breakdown := s.tax()
+	c := mail.Confirmation{
+		OrderID:        s.ID,
+		Email:          s.Email,
+		Address:        s.Address,
+		Country:        s.Country,
+		Currency:       quote.Currency,
+		Subtotal:       quote.Subtotal,
+		Discount:       quote.Discount,
+		ShippingMethod: s.ShippingMethod,
+		Shipping:       s.ShippingCost,
+		TransactionID:  s.TransactionID,
+		ShippingID:     s.ShippingID,
+		Tax:            breakdown.Tax,
+		TaxIncluded:    breakdown.Mode == tax.Inclusive,
+		Total:          s.Total,
+	}
+	for _, l := range quote.Lines {
+		c.Lines = append(c.Lines, mail.Line{
+			Sku:       l.Sku,
+			Name:      l.Name,
+			Qty:       l.Qty,
+			UnitPrice: l.UnitPrice,
+			LineTotal: l.LineTotal,
+		})
+	}
+	return c
+}
+
+// save persists the state of the saga, which renews the lease of its owner.
+func (s *Saga) save() error {
+	s.HeartbeatAt = time.Now()
+	return db.Save(s).Error
+}
+
+// release gives up the lease on a saga that could not be finished, so resumeSagas retries it once the lease
+// has run out.
+func (s *Saga) release() {
+	s.Owner = ""
+	if err := s.save(); err != nil {
+		log.WithFields(log.Fields{
+			"saga": s.ID,
+		}).Error(err)
+	}
+}
+
+// run runs the action of a step. A panic in the action is returned as an error, so the saga is compensated
+// like it is for any other failed step.
+func (step sagaStep) run(s *Saga) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return step.action(s)
+}
+
+// runSaga runs the steps of a saga from where it is. If a step fails, it and the steps that completed before it
+// are compensated in reverse order and a StepError with the error of the failed step is returned.
+func runSaga(s *Saga, steps []sagaStep) error {
+	if err := runSteps(s, steps, len(steps)); err != nil {
+		return err
+	}
+	s.Status = sagaCompleted
+	return s.save()
+}
+
+// runSteps runs the steps of a saga from where it is until n of them have completed, failing like runSaga does.
+func runSteps(s *Saga, steps []sagaStep, n int) error {
+	if err := s.save(); err != nil {
+		return err
+	}
+	for s.Step < n {
+		step := steps[s.Step]
+		if err := step.run(s); err != nil {
+			log.WithFields(log.Fields{
+				"saga": s.ID,
+				"step": step.name,
+			}).Error(err)
+			// The failed step may have gotten halfway, so it is compensated as well
+			stepErr := &StepError{step.name, err}
+			s.Status = sagaCompensating
+			s.FailedStep = step.name
+			s.Error = stepErr.Error()
+			_, s.Code = errorCode(stepErr)
+			s.Step++
+			if err := compensateSaga(s, steps); err != nil {
+				log.WithFields(log.Fields{
+					"saga": s.ID,
+				}).Error(err)
+			}
+			return stepErr
+		}
+		s.Step++
+		if err := s.save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compensateSaga undoes the completed steps of a saga in reverse order. A saga whose compensation fails
+// stays in the compensating state and is released, so resumeSagas retries it.
+func compensateSaga(s *Saga, steps []sagaStep) error {
+	if err := s.save(); err != nil {
+		return err
+	}
+	for s.Step > 0 {
+		step := steps[s.Step-1]
+		if step.compensate != nil {
+			if err := step.compensate(s); err != nil {
+				s.release()
+				return err
+			}
+			log.WithFields(log.Fields{
+				"saga": s.ID,
+				"step": step.name,
+			}).Info("Compensated checkout step")
+		}
+		s.Step--
+		if err := s.save(); err != nil {
+			return err
+		}
+	}
+	s.Status = sagaCompensated
+	return s.save()
+}
+
+// heartbeatSagas renews the lease on the unfinished sagas of this instance every interval, for as long as the
+// service runs. That includes the sagas waiting in checkoutQueue, which no other instance can see.
+func heartbeatSagas(interval time.Duration) {
+	for range time.Tick(interval) {
+		err := db.Model(&Saga{}).Where("owner = ? AND status IN (?)", instanceID, []string{sagaRunning, sagaCompensating}).
+			UpdateColumn("heartbeat_at", time.Now()).Error
+		if err != nil {
+			log.Errorf("Could not renew the lease on checkouts: %v", err)
+		}
+	}
+}
+
+// claimSaga takes over a saga whose lease ran out. Claiming renews the lease, so only one instance can claim
+// a saga and the others get false.
+func claimSaga(s *Saga) (bool, error) {
+	now := time.Now()
+	result := db.Model(&Saga{}).
+		Where("id = ? AND (heartbeat_at IS NULL OR heartbeat_at < ?) AND status IN (?)", s.ID, now.Add(-sagaLease),
+			[]string{sagaRunning, sagaCompensating}).
+		UpdateColumns(map[string]interface{}{"owner": instanceID, "heartbeat_at": now})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	s.Owner = instanceID
+	s.HeartbeatAt = now
+	return true, nil
+}
+
+// resumeSagas picks up abandoned sagas every interval, for as long as the service runs.
+func resumeSagas(steps []sagaStep, interval time.Duration) {
+	for {
+		resumeAbandonedSagas(steps)
+		time.Sleep(interval)
+	}
+}
+
+// resumeAbandonedSagas picks up the sagas whose owner stopped renewing its lease, e.g. because it crashed.
+// Sagas that got past the payment are finished, all others are rolled back. A step may have been running when
+// the owner stopped, so it is retried or compensated as well.
+func resumeAbandonedSagas(steps []sagaStep) {
+	var sagas []*Saga
+	err := db.Where("status IN (?) AND (heartbeat_at IS NULL OR heartbeat_at < ?)", []string{sagaRunning, sagaCompensating},
+		time.Now().Add(-sagaLease)).Find(&sagas).Error
+	if err != nil {
+		log.Errorf("Could not load interrupted checkouts: %v", err)
+		return
+	}
+
+	for _, s := range sagas {
+		claimed, err := claimSaga(s)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"saga": s.ID,
+			}).Error(err)
+		}
+		if !claimed {
+			continue
+		}
+
+		switch {
+		case s.Status == sagaRunning && s.Step > stepPayment:
+			err = runSaga(s, steps)
+		case s.Status == sagaRunning:
+			s.Status = sagaCompensating
+			s.Error = "interrupted before the payment completed"
+			s.Code = codeInternal
+			s.Step++
+			err = compensateSaga(s, steps)
+		default:
+			err = compensateSaga(s, steps)
+		}
+		log.WithFields(log.Fields{
+			"saga":   s.ID,
+			"status": s.Status,
+		}).Info("Resumed interrupted checkout")
+		if err != nil {
+			log.WithFields(log.Fields{
+				"saga": s.ID,
+			}).Error(err)
+		}
+	}
+}
+
+// reserveCart locks the shopping cart and records what is being checked out, so we charge and ship exactly
+// what the user saw. The lock expires by itself if the saga never gets to release it.
+func reserveCart(s *Saga) error {
+	snapshot, err := carts.Lock(context.Background(), s.SessionID)
+	if err != nil {
+		return err
+	}
+	s.Snapshot = snapshot
+
+	quote, err := carts.Quote(context.Background(), s.SessionID, snapshot)
+	if err != nil {
+		return err
+	}
+	if len(quote.Lines) == 0 {
+		return errEmptyCart
+	}
+	for _, l := range quote.Lines {
+		if l.Unavailable {
+			return errUnavailable
+		}
+	}
+	payload, _ := json.Marshal(quote)
+	s.Quote = string(payload)
+
+	// Work out the VAT, which decides what we charge
+	breakdown, err := quoteTax(s.Country, quote)
+	if err != nil {
+		return err
+	}
+	payload, _ = json.Marshal(breakdown)
+	s.Tax = string(payload)
+
+	// And what shipping costs, which is charged on top
+	option, err := shippingRates.Option(s.Country, s.ShippingMethod, quoteWeight(quote), quote.Total, quote.FreeShipping)
+	if err != nil {
+		return err
+	}
+	s.ShippingCost = option.Price
+	s.Total = breakdown.Gross + option.Price
+
+	// Never charge the user another amount than they saw
+	if s.ExpectedTotal != nil && *s.ExpectedTotal != s.Total {
+		return &PriceChangedError{*s.ExpectedTotal, s.priceQuote()}
+	}
+	return nil
+}
+
+// quoteTax works out the VAT on a priced cart shipped to a country.
+func quoteTax(country string, quote cart.Quote) (tax.Breakdown, error) {
+	var lines []tax.Line
+	for _, l := range quote.Lines {
+		lines = append(lines, tax.Line{Sku: l.Sku, Class: l.TaxClass, Amount: l.LineTotal})
+	}
+	return taxRules.Calculate(country, lines, quote.Discount)
+}
+
+// releaseCart unlocks the shopping cart again.
+func releaseCart(s *Saga) error {
+	if s.Snapshot == "" {
+		return nil
+	}
+	return carts.Unlock(context.Background(), s.SessionID, s.Snapshot)
+}
+
+// emptyCart empties the shopping cart that was checked out and unlocks it.
+func emptyCart(s *Saga) error {
+	return carts.Clear(context.Background(), s.SessionID, s.Snapshot)
+}
+
+// chargePayment charges the card of the user.
+func chargePayment(s *Saga) error {
+	transactionid, err := payments.Charge(context.Background(), s.CardToken, s.Total, s.ID)
+	s.TransactionID = transactionid
+	return err
+}
+
+// refundCharge refunds the payment. The saga ID identifies the payment when it never returned a transaction ID.
+func refundCharge(s *Saga) error {
+	return payments.Refund(context.Background(), s.TransactionID, s.ID)
+}
+
+// createShipment ships the products to the user.
+func createShipment(s *Saga) error {
+	shippingid, err := shipments.Ship(context.Background(), shipping.Shipment{
+		Address:   s.Address,
+		Method:    s.ShippingMethod,
+		Items:     s.items(),
+		Reference: s.ID,
+	})
+	s.ShippingID = shippingid
+	return err
+}
+
+// cancelShipment cancels the shipment. The saga ID identifies the shipment when it never returned a shipping ID.
+func cancelShipment(s *Saga) error {
+	return shipments.Cancel(context.Background(), s.ShippingID, s.ID)
+}
+
+// sendConfirmation sends the user an order confirmation email. The order is not undone when the email
+// cannot be sent, so this never fails the saga.
+func sendConfirmation(s *Saga) error {
+	m, err := mail.RenderConfirmation(mailFrom, s.confirmation())
+	if err == nil {
+		err = emails.Send(context.Background(), m)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"saga": s.ID,
+		}).Warn(err)
+	}
+	return nil
+}
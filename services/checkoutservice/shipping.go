@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/clients/cart"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// quoteWeight returns the shipping weight of a priced cart in grams.
+func quoteWeight(quote cart.Quote) int {
+	var weight int
+	for _, l := range quote.Lines {
+		weight += l.Weight * l.Qty
+	}
+	return weight
+}
+
+// getShippingQuote returns the shipping methods the cart of ?sessionid= can be shipped to ?country= with,
+// their prices and how many days they take. The country defaults to NL. It also returns the VAT on the cart
+// in that country and its total with VAT, before shipping, which is what checkout charges for the items.
+func getShippingQuote(c *gin.Context) {
+
+	// Get the session ID and the country
+	sessionid := c.Query("sessionid")
+	if sessionid == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "sessionid is required",
+			"code":  codeInvalidRequest,
+		})
+		return
+	}
+	country := c.DefaultQuery("country", "NL")
+
+	// Price the cart as it is now
+	quote, err := carts.Quote(c.Request.Context(), sessionid, "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sessionid": sessionid,
+		}).Error(err)
+		abortWithError(c, err)
+		return
+	}
+
+	// Work out the shipping methods and the VAT
+	weight := quoteWeight(quote)
+	options, err := shippingRates.Options(country, weight, quote.Total, quote.FreeShipping)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	breakdown, err := quoteTax(country, quote)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	// Return the shipping methods
+	c.JSON(http.StatusOK, gin.H{
+		"country":  country,
+		"currency": quote.Currency,
+		"weight":   weight,
+		"methods":  options,
+		"tax_mode": breakdown.Mode,
+		"tax":      breakdown.Tax,
+		"total":    breakdown.Gross,
+	})
+}
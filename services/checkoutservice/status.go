@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/adenoudsten96/microservices-shop/services/checkoutservice/tax"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often an event stream checks the database for progress, and sends a ping when nothing happened,
+// so proxies do not close it. Polling the database lets any replica stream a checkout that another one runs.
+const (
+	statusPollInterval = 500 * time.Millisecond
+	keepAliveInterval  = 30 * time.Second
+)
+
+// errCheckoutNotFound is returned when there is no checkout with the requested ID.
+var errCheckoutNotFound = errors.New("not found")
+
+// CheckoutStatus is the progress of a checkout. Status is that of its saga: a checkout is done when it is
+// completed, and failed when it is compensated, in which case Error, Code and Step say why.
+type CheckoutStatus struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+
+	// Step is the step that is running, being undone or failed, and Completed the number of steps that are done
+	Step      string `json:"step,omitempty"`
+	Completed int    `json:"completed_steps"`
+	Steps     int    `json:"steps"`
+
+	Error         string         `json:"error,omitempty"`
+	Code          string         `json:"code,omitempty"`
+	TransactionID string         `json:"transactionid,omitempty"`
+	ShippingID    string         `json:"shippingid,omitempty"`
+	Total         int            `json:"total,omitempty"`
+	ShippingCost  int            `json:"shipping_cost,omitempty"`
+	Tax           *tax.Breakdown `json:"tax,omitempty"`
+}
+
+// done reports whether the checkout will not make any more progress.
+func (cs CheckoutStatus) done() bool {
+	return cs.Status == sagaCompleted || cs.Status == sagaCompensated
+}
+
+// checkoutStatus reads the progress of the checkout with the given ID.
+func checkoutStatus(id string) (CheckoutStatus, error) {
+	var s Saga
+	err := db.Where("id = ?", id).First(&s).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return CheckoutStatus{}, errCheckoutNotFound
+	}
+	if err != nil {
+		return CheckoutStatus{}, err
+	}
+
+	status := CheckoutStatus{
+		ID:            s.ID,
+		Status:        s.Status,
+		Steps:         len(checkoutSteps),
+		Error:         s.Error,
+		Code:          s.Code,
+		TransactionID: s.TransactionID,
+		ShippingID:    s.ShippingID,
+		Total:         s.Total,
+		ShippingCost:  s.ShippingCost,
+	}
+	switch s.Status {
+	case sagaRunning:
+		status.Completed = s.Step
+		if s.Step < len(checkoutSteps) {
+			status.Step = checkoutSteps[s.Step].name
+		}
+	case sagaCompensating:
+		if s.Step > 0 && s.Step <= len(checkoutSteps) {
+			status.Step = checkoutSteps[s.Step-1].name
+		}
+	case sagaCompleted:
+		status.Completed = len(checkoutSteps)
+		breakdown := s.tax()
+		status.Tax = &breakdown
+	case sagaCompensated:
+		status.Step = s.FailedStep
+		status.Error = strings.TrimPrefix(s.Error, s.FailedStep+": ")
+	}
+	return status, nil
+}
+
+// getCheckoutStatus returns the progress of a checkout.
+func getCheckoutStatus(c *gin.Context) {
+
+	// Get the checkout ID
+	id := c.Param("id")
+
+	// Read its progress
+	status, err := checkoutStatus(id)
+	if err == errCheckoutNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"saga": id,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Return the progress
+	c.JSON(http.StatusOK, status)
+}
+
+// streamCheckoutStatus streams the progress of a checkout as Server-Sent Events. The current progress is sent
+// as soon as the stream opens, followed by a "status" event every time it changes. The stream ends once the
+// checkout is done.
+func streamCheckoutStatus(c *gin.Context) {
+
+	// Get the checkout ID
+	id := c.Param("id")
+
+	// Read its progress
+	status, err := checkoutStatus(id)
+	if err == errCheckoutNotFound {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"saga": id,
+		}).Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Stream the events until the checkout is done or the client goes away
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("status", status)
+	c.Writer.Flush()
+	if status.done() {
+		return
+	}
+	poll := time.NewTicker(statusPollInterval)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-poll.C:
+			latest, err := checkoutStatus(id)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"saga": id,
+				}).Warn(err)
+				return true
+			}
+			if latest.Status == status.Status && latest.Step == status.Step && latest.Completed == status.Completed {
+				return true
+			}
+			status = latest
+			c.SSEvent("status", status)
+			return !status.done()
+		case <-keepAlive.C:
+			c.SSEvent("ping", "")
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
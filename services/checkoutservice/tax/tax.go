@@ -0,0 +1,171 @@
+// Package tax calculates the VAT of an order from rules per country and product tax class.
+package tax
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// The tax classes a product can be in. Products without a tax class are taxed at the standard rate.
+const (
+	Standard = "standard"
+	Reduced  = "reduced"
+	Zero     = "zero"
+)
+
+// The pricing modes. Inclusive prices already contain VAT, exclusive prices have VAT added on top of them.
+const (
+	Inclusive = "inclusive"
+	Exclusive = "exclusive"
+)
+
+// Rules holds the VAT rates in percent per country and tax class, and the pricing mode they are applied in.
+type Rules struct {
+	Mode  string                        `json:"mode"`
+	Rates map[string]map[string]float64 `json:"rates"`
+}
+
+// DefaultRules are the VAT rates of the countries we ship to, applied to prices that include VAT.
+var DefaultRules = Rules{
+	Mode: Inclusive,
+	Rates: map[string]map[string]float64{
+		"NL": {Standard: 21, Reduced: 9, Zero: 0},
+		"BE": {Standard: 21, Reduced: 6, Zero: 0},
+		"DE": {Standard: 19, Reduced: 7, Zero: 0},
+	},
+}
+
+// Parse reads rules from JSON, for example {"mode": "inclusive", "rates": {"NL": {"standard": 21}}}.
+func Parse(data []byte) (Rules, error) {
+	var rules Rules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return Rules{}, err
+	}
+	if rules.Mode == "" {
+		rules.Mode = Inclusive
+	}
+	if rules.Mode != Inclusive && rules.Mode != Exclusive {
+		return Rules{}, fmt.Errorf("tax mode must be %v or %v", Inclusive, Exclusive)
+	}
+	return rules, nil
+}
+
+// UnknownCountryError is returned when there are no rules for a country.
+type UnknownCountryError struct {
+	Country string
+}
+
+func (e *UnknownCountryError) Error() string {
+	return fmt.Sprintf("we do not ship to %v", e.Country)
+}
+
+// UnknownClassError is returned when a country has no rate for a tax class.
+type UnknownClassError struct {
+	Country string
+	Class   string
+}
+
+func (e *UnknownClassError) Error() string {
+	return fmt.Sprintf("no %v tax rate for %v", e.Class, e.Country)
+}
+
+// Line is a single line of an order to tax. Amount is the price of the line in cents, before discounts.
+type Line struct {
+	Sku    string
+	Class  string
+	Amount int
+}
+
+// LineTax is the tax on a single line of an order. All amounts are in cents, after discounts.
+type LineTax struct {
+	Sku   string  `json:"sku"`
+	Class string  `json:"tax_class"`
+	Rate  float64 `json:"rate"`
+	Net   int     `json:"net"`
+	Tax   int     `json:"tax"`
+	Gross int     `json:"gross"`
+}
+
+// Breakdown is the tax on an order, per line and in total. Gross is the amount to charge.
+type Breakdown struct {
+	Country string    `json:"country"`
+	Mode    string    `json:"mode"`
+	Lines   []LineTax `json:"lines"`
+	Net     int       `json:"net"`
+	Tax     int       `json:"tax"`
+	Gross   int       `json:"gross"`
+}
+
+// Calculate taxes the lines of an order shipped to a country. The discount on the order is spread over
+// the lines in proportion to their amounts, so every line is taxed at its own rate after the discount.
+func (r Rules) Calculate(country string, lines []Line, discount int) (Breakdown, error) {
+	rates, ok := r.Rates[country]
+	if !ok {
+		return Breakdown{}, &UnknownCountryError{country}
+	}
+
+	b := Breakdown{
+		Country: country,
+		Mode:    r.Mode,
+		Lines:   []LineTax{},
+	}
+	discounts := spread(lines, discount)
+	for n, l := range lines {
+		class := l.Class
+		if class == "" {
+			class = Standard
+		}
+		rate, ok := rates[class]
+		if !ok {
+			return Breakdown{}, &UnknownClassError{country, class}
+		}
+
+		lt := LineTax{Sku: l.Sku, Class: class, Rate: rate}
+		amount := l.Amount - discounts[n]
+		if r.Mode == Exclusive {
+			lt.Net = amount
+			lt.Tax = int(math.Round(float64(amount) * rate / 100))
+			lt.Gross = lt.Net + lt.Tax
+		} else {
+			lt.Gross = amount
+			lt.Tax = int(math.Round(float64(amount) * rate / (100 + rate)))
+			lt.Net = lt.Gross - lt.Tax
+		}
+
+		b.Lines = append(b.Lines, lt)
+		b.Net += lt.Net
+		b.Tax += lt.Tax
+		b.Gross += lt.Gross
+	}
+	return b, nil
+}
+
+// spread divides a discount over lines in proportion to their amounts. The cents lost to rounding go to
+// the first lines, so the parts always add up to the discount.
+func spread(lines []Line, discount int) []int {
+	parts := make([]int, len(lines))
+	var total int
+	for _, l := range lines {
+		total += l.Amount
+	}
+	if total == 0 || discount == 0 {
+		return parts
+	}
+	if discount > total {
+		discount = total
+	}
+
+	left := discount
+	for n, l := range lines {
+		parts[n] = discount * l.Amount / total
+		left -= parts[n]
+	}
+	for n := 0; left > 0; n = (n + 1) % len(lines) {
+		if parts[n] < lines[n].Amount {
+			parts[n]++
+			left--
+		}
+	}
+	return parts
+}
@@ -0,0 +1,64 @@
+package tax
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInclusive(t *testing.T) {
+	b, err := DefaultRules.Calculate("NL", []Line{
+		{Sku: "SKU1", Amount: 1210},
+		{Sku: "SKU2", Class: Reduced, Amount: 1090},
+		{Sku: "SKU3", Class: Zero, Amount: 500},
+	}, 0)
+
+	// The VAT is taken out of the prices
+	assert.Nil(t, err)
+	assert.Equal(t, 210, b.Lines[0].Tax)
+	assert.Equal(t, 90, b.Lines[1].Tax)
+	assert.Equal(t, 0, b.Lines[2].Tax)
+	assert.Equal(t, 2800, b.Gross)
+	assert.Equal(t, 2500, b.Net)
+}
+
+func TestExclusive(t *testing.T) {
+	rules := DefaultRules
+	rules.Mode = Exclusive
+	b, err := rules.Calculate("DE", []Line{{Sku: "SKU1", Amount: 1000}}, 0)
+
+	// The VAT is added on top of the prices
+	assert.Nil(t, err)
+	assert.Equal(t, 190, b.Tax)
+	assert.Equal(t, 1190, b.Gross)
+}
+
+func TestDiscount(t *testing.T) {
+	b, _ := DefaultRules.Calculate("NL", []Line{
+		{Sku: "SKU1", Amount: 1000},
+		{Sku: "SKU2", Amount: 2000},
+	}, 301)
+
+	// The discount is spread over the lines and still adds up
+	assert.Equal(t, 899, b.Lines[0].Gross)
+	assert.Equal(t, 1800, b.Lines[1].Gross)
+	assert.Equal(t, 2699, b.Gross)
+}
+
+func TestUnknown(t *testing.T) {
+	_, err := DefaultRules.Calculate("US", []Line{{Sku: "SKU1", Amount: 1000}}, 0)
+	assert.IsType(t, &UnknownCountryError{}, err)
+
+	_, err = DefaultRules.Calculate("NL", []Line{{Sku: "SKU1", Class: "luxury", Amount: 1000}}, 0)
+	assert.IsType(t, &UnknownClassError{}, err)
+}
+
+func TestParse(t *testing.T) {
+	rules, err := Parse([]byte(`{"rates": {"FR": {"standard": 20}}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, Inclusive, rules.Mode)
+	assert.Equal(t, 20.0, rules.Rates["FR"][Standard])
+
+	_, err = Parse([]byte(`{"mode": "sometimes"}`))
+	assert.NotNil(t, err)
+}
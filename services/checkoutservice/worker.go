@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults for the pool of workers that run asynchronous checkouts
+const (
+	defaultWorkers = 4
+	queueSize      = 100
+)
+
+// errQueueFull is returned when more asynchronous checkouts are waiting than the queue holds.
+var errQueueFull = errors.New("too many checkouts are waiting to be processed")
+
+// checkoutQueue holds the sagas of asynchronous checkouts until a worker picks them up
+var checkoutQueue chan *Saga
+
+// startWorkers starts n workers that run the sagas put on checkoutQueue, which holds up to size of them.
+func startWorkers(n, size int) {
+	checkoutQueue = make(chan *Saga, size)
+	for i := 0; i < n; i++ {
+		go func() {
+			for s := range checkoutQueue {
+				runQueuedSaga(s)
+			}
+		}()
+	}
+	log.Printf("Started %v checkout workers", n)
+}
+
+// runQueuedSaga runs the saga of an asynchronous checkout. How it ended is recorded in the saga itself,
+// which is where the status endpoints read it from.
+func runQueuedSaga(s *Saga) {
+	// Panics in steps fail the saga, but compensating or saving it can panic too. That must not take the whole
+	// service down, so the saga is marked failed and released instead, and resumeSagas compensates it.
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{
+				"sessionid": s.SessionID,
+				"saga":      s.ID,
+			}).Errorf("panic: %v", r)
+			s.Status = sagaCompensating
+			s.Error = fmt.Sprintf("panic: %v", r)
+			s.Code = codeInternal
+			s.release()
+		}
+	}()
+
+	if err := runSaga(s, checkoutSteps); err != nil {
+		log.WithFields(log.Fields{
+			"sessionid": s.SessionID,
+			"saga":      s.ID,
+		}).Error(err)
+		return
+	}
+	log.WithFields(log.Fields{
+		"sessionid": s.SessionID,
+		"saga":      s.ID,
+		"total":     s.Total / 100,
+	}).Info("Checked out user")
+}
+
+// enqueueSaga saves the saga of an asynchronous checkout and queues it for a worker. When the queue is full
+// the steps that already ran are compensated and errQueueFull is returned.
+func enqueueSaga(s *Saga) error {
+	if err := s.save(); err != nil {
+		return err
+	}
+	select {
+	case checkoutQueue <- s:
+		return nil
+	default:
+	}
+
+	s.Status = sagaCompensating
+	s.Error = errQueueFull.Error()
+	s.Code = codeServiceUnavailable
+	if err := compensateSaga(s, checkoutSteps); err != nil {
+		log.WithFields(log.Fields{
+			"saga": s.ID,
+		}).Error(err)
+	}
+	return errQueueFull
+}
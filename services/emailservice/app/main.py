@@ -9,6 +9,14 @@ app = Starlette(debug=False)
 @app.route('/email', methods=['POST'])
 async def index(request):
 
+	# Every email needs a recipient, the subject and the text and HTML bodies are rendered by the sender
+	try:
+		message = await request.json()
+	except ValueError:
+		message = None
+	if not isinstance(message, dict) or not message.get("email"):
+		return JSONResponse({"error": "email is required"}, 400)
+
 	# Simulate an email processing
 	time.sleep(1)
 
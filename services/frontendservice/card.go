@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Card is a payment card as entered at checkout.
+type Card struct {
+	Number   string `json:"number"`
+	ExpMonth int    `json:"exp_month"`
+	ExpYear  int    `json:"exp_year"`
+	CVV      string `json:"cvv"`
+	Brand    string `json:"brand"`
+}
+
+// CardError describes what is wrong with a card, in words we can show the shopper.
+type CardError struct {
+	Field   string
+	Message string
+}
+
+func (e *CardError) Error() string {
+	return e.Message
+}
+
+// cardBrand is a card brand we accept, recognised by the prefixes of its card numbers.
+type cardBrand struct {
+	name      string
+	prefixes  [][2]int
+	lengths   []int
+	cvvLength int
+}
+
+// cardBrands are the brands we accept. Prefixes are inclusive ranges of the leading digits of a card number.
+var cardBrands = []cardBrand{
+	{"amex", [][2]int{{34, 34}, {37, 37}}, []int{15}, 4},
+	{"visa", [][2]int{{4, 4}}, []int{13, 16, 19}, 3},
+	{"mastercard", [][2]int{{51, 55}, {2221, 2720}}, []int{16}, 3},
+	{"discover", [][2]int{{6011, 6011}, {644, 649}, {65, 65}}, []int{16, 19}, 3},
+}
+
+// normalizeCardNumber strips the spaces and dashes card numbers are usually written with.
+func normalizeCardNumber(number string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(number)
+}
+
+// luhnValid reports whether a card number of only digits has a valid Luhn check digit.
+func luhnValid(number string) bool {
+	var sum int
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// detectBrand returns the brand of a card number of only digits, if it is one we accept.
+func detectBrand(number string) (cardBrand, bool) {
+	for _, b := range cardBrands {
+		for _, p := range b.prefixes {
+			digits := len(strconv.Itoa(p[0]))
+			if len(number) < digits {
+				continue
+			}
+			prefix, _ := strconv.Atoi(number[:digits])
+			if prefix >= p[0] && prefix <= p[1] {
+				return b, true
+			}
+		}
+	}
+	return cardBrand{}, false
+}
+
+var digitsOnly = regexp.MustCompile(`^[0-9]+$`)
+
+// validateCard checks a card before it is tokenized and fills in its brand. The card number is normalized.
+func validateCard(card *Card, now time.Time) error {
+	card.Number = normalizeCardNumber(card.Number)
+	if !digitsOnly.MatchString(card.Number) || !luhnValid(card.Number) {
+		return &CardError{"number", "Please check your card number."}
+	}
+	brand, ok := detectBrand(card.Number)
+	if !ok {
+		return &CardError{"number", "We accept Visa, Mastercard, American Express and Discover cards."}
+	}
+	validLength := false
+	for _, l := range brand.lengths {
+		validLength = validLength || len(card.Number) == l
+	}
+	if !validLength {
+		return &CardError{"number", "Please check your card number."}
+	}
+	card.Brand = brand.name
+
+	// A card is valid until the end of the month it expires in
+	if card.ExpMonth < 1 || card.ExpMonth > 12 || card.ExpYear < 1 {
+		return &CardError{"expiry", "Please check the expiry date of your card."}
+	}
+	if card.ExpYear < 100 {
+		card.ExpYear += 2000
+	}
+	if card.ExpYear < now.Year() || (card.ExpYear == now.Year() && card.ExpMonth < int(now.Month())) {
+		return &CardError{"expiry", "Your card has expired."}
+	}
+
+	if len(card.CVV) != brand.cvvLength || !digitsOnly.MatchString(card.CVV) {
+		return &CardError{"cvv", fmt.Sprintf("The security code of your card has %v digits.", brand.cvvLength)}
+	}
+	return nil
+}
+
+// checkoutKey derives the idempotency key of a checkout from the key of the checkout form and the card it is
+// paid with. Submitting the form twice is still a single checkout, but a shopper whose card was declined can
+// go back and pay with another card, which is another checkout. The card is keyed with a secret, so the key
+// gives nothing away about it.
+func checkoutKey(formKey string, card Card) string {
+	if formKey == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, sessionSecret)
+	fmt.Fprintf(mac, "%v|%v|%v", card.Number, card.ExpMonth, card.ExpYear)
+	return formKey + "." + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// tokenizeCard hands a card to the vault of the paymentservice, so only the token it returns travels on
+// to the checkoutservice. The raw card data never leaves the frontend in any other way. Tokenizing the same
+// card again with the same idempotency key returns the same token, so a resubmitted checkout stays the same request.
+func tokenizeCard(card Card, idempotencyKey string) (string, int, error) {
+	url := fmt.Sprintf("%v/tokenize", paymentservice)
+	payload, _ := json.Marshal(card)
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	log.WithFields(log.Fields{
+		"brand": card.Brand,
+		"last4": card.Number[len(card.Number)-4:],
+	}).Info("Calling service paymentservice...")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Error(err)
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	// Read HTTP body
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err)
+		return "", 0, err
+	}
+
+	if resp.StatusCode != 200 {
+		return "", resp.StatusCode, errors.New(string(result))
+	}
+
+	var token struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(result, &token); err != nil {
+		return "", 0, err
+	}
+
+	return token.Token, 200, nil
+}
+
+// cardNumbers matches what could be a card number in a log line, 12 to 19 digits optionally grouped
+// with spaces or dashes
+var cardNumbers = regexp.MustCompile(`\b[0-9](?:[ -]?[0-9]){11,18}\b`)
+
+// maskCardNumbers replaces every card number in s with stars, keeping its last four digits.
+func maskCardNumbers(s string) string {
+	return cardNumbers.ReplaceAllStringFunc(s, func(match string) string {
+		number := normalizeCardNumber(match)
+		if !luhnValid(number) {
+			return match
+		}
+		return strings.Repeat("*", len(number)-4) + number[len(number)-4:]
+	})
+}
+
+// cardFields are log fields that hold card data, which are never logged at all
+var cardFields = map[string]bool{
+	"card":       true,
+	"creditcard": true,
+	"number":     true,
+	"cvv":        true,
+}
+
+// maskHook masks card data in everything that is logged.
+type maskHook struct{}
+
+func (maskHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (maskHook) Fire(entry *log.Entry) error {
+	entry.Message = maskCardNumbers(entry.Message)
+	for k, v := range entry.Data {
+		if cardFields[strings.ToLower(k)] {
+			entry.Data[k] = "[masked]"
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			entry.Data[k] = maskCardNumbers(v)
+		case error:
+			entry.Data[k] = maskCardNumbers(v.Error())
+		}
+	}
+	return nil
+}
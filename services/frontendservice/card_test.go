@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCard(t *testing.T) {
+	now := time.Date(2024, time.June, 15, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name  string
+		card  Card
+		brand string
+		field string
+	}{
+		{"visa", Card{Number: "4432-8015-6152-0454", ExpMonth: 6, ExpYear: 2024, CVV: "672"}, "visa", ""},
+		{"amex", Card{Number: "3782 822463 10005", ExpMonth: 1, ExpYear: 2030, CVV: "1234"}, "amex", ""},
+		{"mastercard", Card{Number: "5555555555554444", ExpMonth: 1, ExpYear: 2030, CVV: "123"}, "mastercard", ""},
+		{"mastercard 2-series", Card{Number: "2223003122003222", ExpMonth: 1, ExpYear: 2030, CVV: "123"}, "mastercard", ""},
+		{"discover", Card{Number: "6011111111111117", ExpMonth: 1, ExpYear: 2030, CVV: "123"}, "discover", ""},
+		{"two digit year", Card{Number: "4432801561520454", ExpMonth: 1, ExpYear: 30, CVV: "123"}, "visa", ""},
+		{"check digit", Card{Number: "4432801561520455", ExpMonth: 1, ExpYear: 2030, CVV: "123"}, "", "number"},
+		{"letters", Card{Number: "4432a01561520454", ExpMonth: 1, ExpYear: 2030, CVV: "123"}, "", "number"},
+		{"unknown brand", Card{Number: "9000000000000001", ExpMonth: 1, ExpYear: 2030, CVV: "123"}, "", "number"},
+		{"length", Card{Number: "400000000000006", ExpMonth: 1, ExpYear: 2030, CVV: "123"}, "", "number"},
+		{"expired", Card{Number: "4432801561520454", ExpMonth: 5, ExpYear: 2024, CVV: "123"}, "", "expiry"},
+		{"expired last year", Card{Number: "4432801561520454", ExpMonth: 12, ExpYear: 2023, CVV: "123"}, "", "expiry"},
+		{"month", Card{Number: "4432801561520454", ExpMonth: 13, ExpYear: 2030, CVV: "123"}, "", "expiry"},
+		{"amex cvv", Card{Number: "378282246310005", ExpMonth: 1, ExpYear: 2030, CVV: "123"}, "", "cvv"},
+		{"visa cvv", Card{Number: "4432801561520454", ExpMonth: 1, ExpYear: 2030, CVV: "1234"}, "", "cvv"},
+	} {
+		card := tc.card
+		err := validateCard(&card, now)
+		if tc.field == "" {
+			assert.Nil(t, err, tc.name)
+			assert.Equal(t, tc.brand, card.Brand, tc.name)
+			assert.NotContains(t, card.Number, " ", tc.name)
+			assert.NotContains(t, card.Number, "-", tc.name)
+			continue
+		}
+		if cardErr, ok := err.(*CardError); assert.True(t, ok, tc.name) {
+			assert.Equal(t, tc.field, cardErr.Field, tc.name)
+		}
+	}
+}
+
+func TestMaskCardNumbers(t *testing.T) {
+	assert.Equal(t, "paid with ************0454", maskCardNumbers("paid with 4432-8015-6152-0454"))
+	assert.Equal(t, "paid with ***********0005", maskCardNumbers("paid with 3782 822463 10005"))
+
+	// Numbers that are no card numbers are left alone
+	assert.Equal(t, "order 1234567890123", maskCardNumbers("order 1234567890123"))
+
+	// And card fields are never logged at all
+	entry := log.NewEntry(log.New()).WithFields(log.Fields{
+		"cvv":     "672",
+		"message": "card 4432801561520454",
+	})
+	entry.Message = "paying with 4432801561520454"
+	assert.Nil(t, maskHook{}.Fire(entry))
+	assert.Equal(t, "paying with ************0454", entry.Message)
+	assert.Equal(t, "[masked]", entry.Data["cvv"])
+	assert.Equal(t, "card ************0454", entry.Data["message"])
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// CheckoutStatus is the progress of a checkout, as returned by the checkoutservice
+type CheckoutStatus struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	Step          string `json:"step"`
+	Completed     int    `json:"completed_steps"`
+	Steps         int    `json:"steps"`
+	Error         string `json:"error"`
+	Code          string `json:"code"`
+	TransactionID string `json:"transactionid"`
+	ShippingID    string `json:"shippingid"`
+	Total         int    `json:"total"`
+}
+
+// getCheckoutStatus calls the checkoutservice to get the progress of a checkout.
+func getCheckoutStatus(id string) (CheckoutStatus, int, error) {
+	u := fmt.Sprintf("%v/checkout/%v/status", checkoutservice, url.PathEscape(id))
+
+	log.Info("Calling service checkoutservice...")
+	resp, err := http.Get(u)
+	if err != nil {
+		log.Error(err)
+		return CheckoutStatus{}, 0, err
+	}
+	defer resp.Body.Close()
+
+	// Read HTTP body
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err)
+		return CheckoutStatus{}, 0, err
+	}
+
+	if resp.StatusCode != 200 {
+		return CheckoutStatus{}, resp.StatusCode, errors.New(string(result))
+	}
+
+	var status CheckoutStatus
+	if err := json.Unmarshal(result, &status); err != nil {
+		return CheckoutStatus{}, 0, err
+	}
+
+	return status, 200, nil
+}
+
+// checkoutStatusPage shows how a checkout is getting on. While the order is being placed the page waits for
+// it to finish, after which it shows the placed order or why it could not be placed.
+func checkoutStatusPage(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	status, code, err := getCheckoutStatus(id)
+	if err != nil {
+		log.Error(err)
+		if code == 0 {
+			code = http.StatusBadGateway
+		}
+		renderError(w, r, code, err)
+		return
+	}
+
+	switch status.Status {
+	case "completed":
+		type CheckoutResponse struct {
+			OrderID       string
+			TransactionID string
+			ShippingID    string
+		}
+		err = tpl.ExecuteTemplate(w, "checkout.html", map[string]interface{}{
+			"response": CheckoutResponse{status.ID, status.TransactionID, status.ShippingID},
+			"total":    status.Total,
+		})
+	case "compensated":
+		log.WithFields(log.Fields{
+			"code": status.Code,
+		}).Error(status.Error)
+		msg, ok := checkoutMessages[status.Code]
+		if !ok {
+			msg = status.Error
+		}
+		if status.Code == "price_changed" {
+			msg = fmt.Sprintf(msg, status.Total)
+		}
+		renderError(w, r, http.StatusUnprocessableEntity, errors.New(msg))
+		return
+	default:
+		var progress int
+		if status.Steps > 0 {
+			progress = 100 * status.Completed / status.Steps
+		}
+		err = tpl.ExecuteTemplate(w, "pending.html", map[string]interface{}{
+			"status":   status,
+			"progress": progress,
+		})
+	}
+	if err != nil {
+		log.Error(err)
+	}
+}
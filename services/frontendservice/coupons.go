@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func applyCouponCode(w http.ResponseWriter, r *http.Request) {
+	sessionid := sessionID(r)
+
+	r.ParseForm()
+	status, err := applyCoupon(sessionid, r.PostFormValue("code"))
+
+	// Show why a coupon was refused on the cart page, anything else is an error
+	if status == http.StatusUnprocessableEntity {
+		http.Redirect(w, r, "/cart?coupon_error="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		renderError(w, r, status, err)
+		return
+	}
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+func removeCouponCode(w http.ResponseWriter, r *http.Request) {
+	sessionid := sessionID(r)
+
+	r.ParseForm()
+	status, err := removeCoupon(sessionid, r.PostFormValue("code"))
+	if err != nil {
+		log.Error(err)
+		renderError(w, r, status, err)
+		return
+	}
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+func applyCoupon(sessionid, code string) (int, error) {
+	// Apply the coupon by calling the cartservice
+	url := fmt.Sprintf("%v/cart/%v/coupons", cartservice, sessionid)
+	log.Info("Calling service cartservice...")
+	jsonValue, err := json.Marshal(map[string]string{"code": code})
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Read HTTP body
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		var cr struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(result, &cr)
+		return resp.StatusCode, errors.New(cr.Error)
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != 201 {
+		return resp.StatusCode, errors.New(string(result))
+	}
+
+	return resp.StatusCode, nil
+}
+
+func removeCoupon(sessionid, code string) (int, error) {
+	code = url.PathEscape(code)
+	url := fmt.Sprintf("%v/cart/%v/coupons/%v", cartservice, sessionid, code)
+
+	// Create request
+	client := &http.Client{}
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+
+	// Fetch Request
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Read Response Body
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+
+	if resp.StatusCode != 200 {
+		return resp.StatusCode, errors.New(string(result))
+	}
+
+	return 200, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// cartEvents passes the stream of changes to the shoppers cart on from cartservice to the browser.
+func cartEvents(w http.ResponseWriter, r *http.Request) {
+	sessionid := sessionID(r)
+	proxyEvents(w, r, fmt.Sprintf("%v/cart/%v/events", cartservice, sessionid))
+}
+
+// checkoutEvents passes the stream of progress of a checkout on from checkoutservice to the browser.
+func checkoutEvents(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	proxyEvents(w, r, fmt.Sprintf("%v/checkout/%v/events", checkoutservice, url.PathEscape(id)))
+}
+
+// proxyEvents passes the stream of Server-Sent Events at u on to the browser.
+func proxyEvents(w http.ResponseWriter, r *http.Request, u string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Open the stream, it is closed as soon as the browser goes away
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req = req.WithContext(r.Context())
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		http.Error(w, resp.Status, resp.StatusCode)
+		return
+	}
+
+	// Copy every event as soon as it arrives
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	buf := make([]byte, 4096)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			flusher.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
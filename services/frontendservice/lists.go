@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// listTitles maps the lists kept by cartservice to the title we show shoppers.
+var listTitles = map[string]string{
+	"saved":    "Saved for later",
+	"wishlist": "Wishlist",
+}
+
+func listPage(w http.ResponseWriter, r *http.Request) {
+
+	// Check if the list exists
+	list := mux.Vars(r)["list"]
+	title, ok := listTitles[list]
+	if !ok {
+		renderError(w, r, http.StatusNotFound, errors.New("no such list"))
+		return
+	}
+
+	sessionid := sessionID(r)
+
+	if r.Method == "POST" {
+
+		// Get the form values
+		r.ParseForm()
+		sku := r.PostFormValue("sku")
+		qty, _ := strconv.Atoi(r.PostFormValue("qty"))
+
+		// Add the item to the list
+		status, err := addToList(sessionid, list, sku, qty)
+
+		// Render the error page if something went wrong
+		if status != 201 {
+			log.Error(err)
+			renderError(w, r, status, err)
+			return
+		}
+	}
+
+	// Get the items on the list
+	items, status, err := getList(sessionid, list)
+	if err != nil {
+		log.Error(err)
+		renderError(w, r, status, err)
+		return
+	}
+
+	products, status, err := getProducts()
+	// Render error page if something went wrong
+	if status != 200 {
+		log.Error(err)
+		renderError(w, r, status, err)
+		return
+	}
+	irs, _ := itemRows(items.Items, products)
+
+	// Render template
+	err = tpl.ExecuteTemplate(w, "list.html", map[string]interface{}{
+		"list":  list,
+		"title": title,
+		"items": irs})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func removeListItem(w http.ResponseWriter, r *http.Request) {
+	list := mux.Vars(r)["list"]
+	sessionid := sessionID(r)
+
+	r.ParseForm()
+	status, err := removeFromList(sessionid, list, r.PostFormValue("sku"))
+	if err != nil {
+		log.Error(err)
+		renderError(w, r, status, err)
+		return
+	}
+
+	http.Redirect(w, r, "/lists/"+list, http.StatusSeeOther)
+}
+
+func moveCartItem(w http.ResponseWriter, r *http.Request) {
+	sessionid := sessionID(r)
+
+	// Get the form values
+	r.ParseForm()
+	sku := r.PostFormValue("sku")
+	from := r.PostFormValue("from")
+	to := r.PostFormValue("to")
+
+	status, err := moveItem(sessionid, sku, from, to)
+	if err != nil {
+		log.Error(err)
+		renderError(w, r, status, err)
+		return
+	}
+
+	// Go back to the cart if it was involved, otherwise show the list the item went to
+	if from == "cart" || to == "cart" {
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/lists/"+to, http.StatusSeeOther)
+}
+
+func getList(sessionid, list string) (Cart, int, error) {
+	url := fmt.Sprintf("%v/cart/%v/lists/%v", cartservice, sessionid, list)
+
+	log.Info("Calling service cartservice...")
+	resp, err := http.Get(url)
+	if err != nil {
+		log.Error(err)
+		return Cart{}, 0, err
+	}
+	defer resp.Body.Close()
+
+	// Read HTTP body
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err)
+		return Cart{}, 0, err
+	}
+
+	if resp.StatusCode != 200 {
+		return Cart{}, resp.StatusCode, errors.New(string(result))
+	}
+
+	var items Cart
+	if err := json.Unmarshal(result, &items); err != nil {
+		return Cart{}, 0, err
+	}
+
+	return items, 200, nil
+}
+
+func addToList(sessionid, list, sku string, qty int) (int, error) {
+	// Add the item to the list by calling the cartservice
+	url := fmt.Sprintf("%v/cart/%v/lists/%v", cartservice, sessionid, list)
+	log.Info("Calling service cartservice...")
+	items := Cart{
+		Items: []Item{Item{Sku: sku, Qty: qty}},
+	}
+	jsonValue, err := json.Marshal(items)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Read HTTP body
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+
+	if resp.StatusCode != 201 {
+		return resp.StatusCode, errors.New(string(result))
+	}
+
+	return 201, nil
+}
+
+func removeFromList(sessionid, list, sku string) (int, error) {
+	url := fmt.Sprintf("%v/cart/%v/lists/%v/%v", cartservice, sessionid, list, sku)
+
+	// Create request
+	client := &http.Client{}
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+
+	// Fetch Request
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Read Response Body
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+
+	if resp.StatusCode != 200 {
+		return resp.StatusCode, errors.New(string(result))
+	}
+
+	return 200, nil
+}
+
+func moveItem(sessionid, sku, from, to string) (int, error) {
+	// Move the item by calling the cartservice
+	url := fmt.Sprintf("%v/cart/%v/move", cartservice, sessionid)
+	log.Info("Calling service cartservice...")
+	jsonValue, err := json.Marshal(map[string]string{
+		"sku":  sku,
+		"from": from,
+		"to":   to,
+	})
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Read HTTP body
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+
+	if resp.StatusCode != 200 {
+		return resp.StatusCode, errors.New(string(result))
+	}
+
+	return 200, nil
+}
@@ -22,6 +22,8 @@ var (
 	cartservice     = mustMapEnv("CARTSERVICE")
 	productservice  = mustMapEnv("PRODUCTSERVICE")
 	checkoutservice = mustMapEnv("CHECKOUTSERVICE")
+	paymentservice  = mustMapEnv("PAYMENTSERVICE")
+	sessionSecret   = []byte(mustMapEnv("SESSION_SECRET"))
 )
 
 // ProductResponse is the response that comes back from the productservice
@@ -37,6 +39,35 @@ type Cart struct {
 	Items []Item `json:"items" binding:"required"`
 }
 
+// Quote is a fully priced shopping cart, as calculated by the cartservice
+type Quote struct {
+	Currency     string      `json:"currency"`
+	Lines        []QuoteLine `json:"lines"`
+	Subtotal     int         `json:"subtotal"`
+	Discounts    []Discount  `json:"discounts"`
+	Discount     int         `json:"discount"`
+	FreeShipping bool        `json:"free_shipping"`
+	Total        int         `json:"total"`
+}
+
+// QuoteLine is a single priced item in a Quote
+type QuoteLine struct {
+	Sku         string `json:"sku"`
+	Name        string `json:"name"`
+	Qty         int    `json:"qty"`
+	UnitPrice   int    `json:"unit_price"`
+	LineTotal   int    `json:"line_total"`
+	Unavailable bool   `json:"unavailable"`
+}
+
+// Discount is a coupon applied to a cart and the amount it takes off
+type Discount struct {
+	Code         string `json:"code"`
+	Type         string `json:"type"`
+	Amount       int    `json:"amount"`
+	FreeShipping bool   `json:"free_shipping"`
+}
+
 // Item represents the items in a Cart
 type Item struct {
 	Sku string `json:"sku" binding:"required"`
@@ -47,21 +78,11 @@ func init() {
 	tpl = template.Must(template.ParseGlob("templates/*"))
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetOutput(os.Stdout)
+	log.AddHook(maskHook{})
 }
 
 func homePage(w http.ResponseWriter, r *http.Request) {
 
-	// Set the sessionID in a cookie if there isn't already one set
-	_, err := r.Cookie("sessionid")
-	if err != nil {
-		uuid, err := uuid.NewV4()
-		if err != nil {
-			log.Error(err)
-		}
-		cookie := http.Cookie{Name: "sessionid", Value: uuid.String(), Expires: time.Now().Add(1 * time.Hour)}
-		http.SetCookie(w, &cookie)
-	}
-
 	// Get all products
 	products, status, err := getProducts()
 	// Render error page if something went wrong
@@ -112,11 +133,7 @@ func cartPage(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		sku := r.PostFormValue("sku")
 		qtystr := r.PostFormValue("qty")
-		cookie, err := r.Cookie("sessionid")
-		if err != nil {
-			log.Error(err)
-		}
-		sessionid := cookie.Value
+		sessionid := sessionID(r)
 		qty, _ := strconv.Atoi(qtystr)
 
 		// Add the items to the cart
@@ -131,42 +148,79 @@ func cartPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get the users shopping cart
-	ck, err := r.Cookie("sessionid")
-	if err != nil {
-		log.Error(err)
-		renderError(w, r, 0, err)
-	}
-	sessionid := ck.Value
-	cart, status, err := getCart(sessionid)
+	sessionid := sessionID(r)
 
+	// Get the priced shopping cart, so we show the same totals checkout will charge
+	quote, status, err := getQuote(sessionid)
 	if err != nil {
 		log.Error(err)
 		renderError(w, r, status, err)
 		return
 	}
 
-	// Match the items in the shopping cart to products
-	// Prepare a struct to render the page with
-	// Count up total money owed
-	type ItemRow struct {
-		Sku      string
-		Name     string
-		Price    int
-		Quantity int
+	// Get the ways the cart can be shipped to the chosen country and the VAT there. Without them the cart
+	// is still shown.
+	country := r.URL.Query().Get("country")
+	if country == "" {
+		country = "NL"
+	}
+	shipping, _, err := getShippingQuote(sessionid, country)
+	if err != nil {
+		log.Warn(err)
 	}
 
-	var irs []ItemRow
-	var total int
+	// The total includes the VAT of the chosen country, which is added on top of the prices when they exclude
+	// it. This is the total that is posted to checkout, so it has to be exactly what checkout charges.
+	total := quote.Total
+	if err == nil {
+		total = shipping.Total
+	}
 
-	products, status, err := getProducts()
-	// Render error page if something went wrong
-	if status != 200 {
+	// Every render of the checkout form gets its own idempotency key, so submitting it twice checks out once
+	key, err := uuid.NewV4()
+	if err != nil {
 		log.Error(err)
-		renderError(w, r, status, err)
+		renderError(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	for _, v := range cart.Items {
+	// Cards can be entered that expire this year or in the ten years after it
+	var years []int
+	for y := time.Now().Year(); y <= time.Now().Year()+10; y++ {
+		years = append(years, y)
+	}
+
+	// Render template
+	err = tpl.ExecuteTemplate(w, "cart.html", map[string]interface{}{
+		"idempotency_key": key.String(),
+		"card_years":      years,
+		"country":         country,
+		"shipping":        shipping.Methods,
+		"items":           quoteRows(quote.Lines),
+		"subtotal":        quote.Subtotal,
+		"discounts":       quote.Discounts,
+		"tax":             shipping.Tax,
+		"tax_mode":        shipping.TaxMode,
+		"coupon_error":    r.URL.Query().Get("coupon_error"),
+		"total":           total})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// ItemRow is a single item of a cart or list, prepared to render a page with.
+type ItemRow struct {
+	Sku      string
+	Name     string
+	Price    int
+	Quantity int
+}
+
+// itemRows matches items to products and counts up the total money owed for them.
+func itemRows(items []Item, products []ProductResponse) ([]ItemRow, int) {
+	var irs []ItemRow
+	var total int
+	for _, v := range items {
 		var ir ItemRow
 		for _, c := range products {
 			if v.Sku == c.SKU {
@@ -179,41 +233,100 @@ func cartPage(w http.ResponseWriter, r *http.Request) {
 		irs = append(irs, ir)
 		total = total + (v.Qty * ir.Price)
 	}
+	return irs, total
+}
 
-	// Render template
-	err = tpl.ExecuteTemplate(w, "cart.html", map[string]interface{}{
-		"items": irs,
-		"total": total})
-	if err != nil {
-		log.Error(err)
-	}
+// quoteRows turns the lines of a priced cart into rows to render a page with.
+func quoteRows(lines []QuoteLine) []ItemRow {
+	var irs []ItemRow
+	for _, l := range lines {
+		irs = append(irs, ItemRow{
+			Sku:      l.Sku,
+			Name:     l.Name,
+			Price:    l.UnitPrice,
+			Quantity: l.Qty,
+		})
+	}
+	return irs
+}
+
+// checkoutMessages maps the error codes of a failed checkout to the message we show shoppers.
+var checkoutMessages = map[string]string{
+	"invalid_request":     "Please fill in all the fields of the checkout form.",
+	"empty_cart":          "Your shopping cart is empty.",
+	"product_unavailable": "Some products in your shopping cart are no longer available, please remove them first.",
+	"unsupported_product": "Some products in your shopping cart cannot be sold in the country you ship to.",
+	"price_changed":       "Prices changed while you were checking out, your order now costs €%v. Please check your shopping cart and place your order again.",
+	"cart_locked":         "Your order is already being placed, please wait a moment.",
+	"payment_declined":    "Your card was declined, please try another card.",
+	"invalid_card":        "We could not charge your card, please enter it again.",
+	"service_unavailable": "We cannot take orders right now, please try again in a few minutes. Any charge for it will be refunded.",
+	"service_timeout":     "Placing your order took too long, please try again. Any charge for it will be refunded.",
+	"service_error":       "Something went wrong while placing your order, please try again. Any charge for it will be refunded.",
+	"internal_error":      "Something went wrong while placing your order, please try again.",
 }
 
 func checkoutPage(w http.ResponseWriter, r *http.Request) {
 	// Get form values and sessionID
 	r.ParseForm()
 	address := r.PostFormValue("street_address")
-	creditcard := r.PostFormValue("credit_card_number")
 	email := r.PostFormValue("email")
-	total := r.PostFormValue("total")
-	cookie, _ := r.Cookie("sessionid")
-	sessionid := cookie.Value
+	country := r.PostFormValue("country")
+	shippingMethod := r.PostFormValue("shipping_method")
+	idempotencyKey := r.PostFormValue("idempotency_key")
+	sessionid := sessionID(r)
+
+	// Check the card and swap it for a token, so the card itself goes no further than here
+	card := Card{
+		Number: r.PostFormValue("credit_card_number"),
+		CVV:    r.PostFormValue("credit_card_cvv"),
+	}
+	card.ExpMonth, _ = strconv.Atoi(r.PostFormValue("credit_card_expiration_month"))
+	card.ExpYear, _ = strconv.Atoi(r.PostFormValue("credit_card_expiration_year"))
+	if err := validateCard(&card, time.Now()); err != nil {
+		renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	idempotencyKey = checkoutKey(idempotencyKey, card)
+	token, status, err := tokenizeCard(card, idempotencyKey)
+	if err != nil {
+		log.Error(err)
+		if status == 0 {
+			status = http.StatusBadGateway
+		}
+		renderError(w, r, status, errors.New("We could not verify your card, please try again."))
+		return
+	}
 
-	// Prepare JSON payload
-	payload := map[string]string{
-		"SessionID":  sessionid,
-		"Address":    address,
-		"Email":      email,
-		"Creditcard": creditcard,
+	// Prepare JSON payload. The total the shopper saw is passed on, so they are never charged anything else.
+	payload := map[string]interface{}{
+		"sessionid":       sessionid,
+		"address":         address,
+		"email":           email,
+		"card_token":      token,
+		"country":         country,
+		"shipping_method": shippingMethod,
+	}
+	total, err := strconv.Atoi(r.PostFormValue("total"))
+	shippingPrice, shippingErr := strconv.Atoi(r.PostFormValue("shipping_price_" + shippingMethod))
+	if err == nil && shippingErr == nil {
+		payload["expected_total"] = total + shippingPrice
 	}
 	jsonPayload, _ := json.Marshal(payload)
 
-	// Check the user out by calling the checkoutservice
-	url := fmt.Sprintf("%v/checkout", checkoutservice)
+	// Check the user out by calling the checkoutservice, which places the order in the background
+	url := fmt.Sprintf("%v/checkout?async=true", checkoutservice)
 	log.Info("Calling service checkoutservice...")
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonPayload))
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonPayload))
+	req.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		log.Error(err)
+		renderError(w, r, http.StatusBadGateway, err)
+		return
 	}
 	defer resp.Body.Close()
 
@@ -223,46 +336,40 @@ func checkoutPage(w http.ResponseWriter, r *http.Request) {
 		log.Error(err)
 	}
 
-	// Unmarshal response
-	type CheckoutResponse struct {
-		TransactionID string
-		ShippingID    string
-	}
-	var cr CheckoutResponse
-	json.Unmarshal(result, &cr)
-
-	// Render error page if something went wrong
-	if resp.StatusCode != 200 {
-		log.Error(err)
-		renderError(w, r, resp.StatusCode, errors.New(string(result)))
-		return
-	}
-
-	// Empty the shopping cart and render the page if the checkout was succesful
-	status, err := deleteCart(sessionid)
-	if err != nil {
-		log.Error(err)
-		renderError(w, r, status, err)
+	// Render error page if something went wrong, with a message the shopper understands
+	if resp.StatusCode != http.StatusAccepted {
+		var ce struct {
+			Error string `json:"error"`
+			Code  string `json:"code"`
+			Quote struct {
+				Total int `json:"total"`
+			} `json:"quote"`
+		}
+		json.Unmarshal(result, &ce)
+		log.WithFields(log.Fields{
+			"code": ce.Code,
+		}).Error(ce.Error)
+		msg, ok := checkoutMessages[ce.Code]
+		if !ok {
+			msg = string(result)
+		}
+		if ce.Code == "price_changed" {
+			msg = fmt.Sprintf(msg, ce.Quote.Total)
+		}
+		renderError(w, r, resp.StatusCode, errors.New(msg))
 		return
 	}
 
-	err = tpl.ExecuteTemplate(w, "checkout.html", map[string]interface{}{
-		"response": cr,
-		"total":    total,
-	})
-	if err != nil {
-		log.Error(err)
+	// Follow the order on its status page
+	var accepted struct {
+		OrderID string `json:"orderid"`
 	}
+	json.Unmarshal(result, &accepted)
+	http.Redirect(w, r, "/checkout/"+accepted.OrderID, http.StatusSeeOther)
 }
 
 func emptyCart(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("sessionid")
-	if err != nil {
-		log.Error(err)
-		renderError(w, r, 0, err)
-		return
-	}
-	sessionid := cookie.Value
+	sessionid := sessionID(r)
 
 	status, err := deleteCart(sessionid)
 	if err != nil {
@@ -338,14 +445,14 @@ func addToCart(sessionid, sku string, qty int) (int, error) {
 	return 201, nil
 }
 
-func getCart(sessionid string) (Cart, int, error) {
-	url := fmt.Sprintf("%v/cart/%v", cartservice, sessionid)
+func getQuote(sessionid string) (Quote, int, error) {
+	url := fmt.Sprintf("%v/cart/%v/quote", cartservice, sessionid)
 
 	log.Info("Calling service cartservice...")
 	resp, err := http.Get(url)
 	if err != nil {
 		log.Error(err)
-		return Cart{}, 0, err
+		return Quote{}, 0, err
 	}
 	defer resp.Body.Close()
 
@@ -353,18 +460,19 @@ func getCart(sessionid string) (Cart, int, error) {
 	result, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Error(err)
-		return Cart{}, 0, err
+		return Quote{}, 0, err
 	}
 
 	if resp.StatusCode != 200 {
-		log.Error(err)
-		return Cart{}, resp.StatusCode, errors.New(string(result))
+		return Quote{}, resp.StatusCode, errors.New(string(result))
 	}
 
-	var cart Cart
-	json.Unmarshal(result, &cart)
+	var quote Quote
+	if err := json.Unmarshal(result, &quote); err != nil {
+		return Quote{}, 0, err
+	}
 
-	return cart, 200, nil
+	return quote, 200, nil
 }
 
 func deleteCart(sessionid string) (int, error) {
@@ -423,11 +531,23 @@ func healthCheck(w http.ResponseWriter, r *http.Request) {
 func main() {
 
 	r := mux.NewRouter()
+	r.Use(sessionMiddleware)
 	r.HandleFunc("/", homePage).Methods(http.MethodGet)
 	r.HandleFunc("/product/{SKU}", productPage).Methods(http.MethodGet)
 	r.HandleFunc("/cart", cartPage).Methods(http.MethodGet, http.MethodPost)
 	r.HandleFunc("/cart/empty", emptyCart).Methods(http.MethodGet)
+	r.HandleFunc("/cart/events", cartEvents).Methods(http.MethodGet)
+	r.HandleFunc("/cart/move", moveCartItem).Methods(http.MethodPost)
+	r.HandleFunc("/cart/coupon", applyCouponCode).Methods(http.MethodPost)
+	r.HandleFunc("/cart/coupon/remove", removeCouponCode).Methods(http.MethodPost)
+	r.HandleFunc("/cart/share", shareCartLink).Methods(http.MethodPost)
+	r.HandleFunc("/shared/{token}", sharedCartPage).Methods(http.MethodGet)
+	r.HandleFunc("/shared/{token}/copy", copySharedCartItems).Methods(http.MethodPost)
+	r.HandleFunc("/lists/{list}", listPage).Methods(http.MethodGet, http.MethodPost)
+	r.HandleFunc("/lists/{list}/remove", removeListItem).Methods(http.MethodPost)
 	r.HandleFunc("/checkout", checkoutPage).Methods(http.MethodGet, http.MethodPost)
+	r.HandleFunc("/checkout/{id}", checkoutStatusPage).Methods(http.MethodGet)
+	r.HandleFunc("/checkout/{id}/events", checkoutEvents).Methods(http.MethodGet)
 	r.HandleFunc("/health", checkoutPage).Methods(http.MethodGet)
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 	log.Info("Starting service frontend")
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// sessionContextKey is the key under which the session token of a request is stored in its context
+type sessionContextKey struct{}
+
+// sessionPattern matches the UUIDs we use as session IDs
+var sessionPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// signSession creates the session token for a session ID: <session id>.<signature>.
+// cartservice checks the signature with the same secret, so nobody can make up a token for somebody else's cart.
+func signSession(id string) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validSession reports whether token is a session token we issued.
+func validSession(token string) bool {
+	dot := strings.LastIndex(token, ".")
+	if dot < 0 || !sessionPattern.MatchString(token[:dot]) {
+		return false
+	}
+	return hmac.Equal([]byte(signSession(token[:dot])), []byte(token))
+}
+
+// sessionMiddleware makes sure every visitor has a valid session token in the sessionid cookie.
+// Anybody without one gets a new random session ID. An ID the client came up with, like the bare UUIDs
+// of cookies from before sessions were signed, is never signed, or it could be the ID of somebody else's cart.
+func sessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if cookie, err := r.Cookie("sessionid"); err == nil {
+			token = cookie.Value
+		}
+
+		if !validSession(token) {
+			u, err := uuid.NewV4()
+			if err != nil {
+				log.Error(err)
+				renderError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			token = signSession(u.String())
+			http.SetCookie(w, &http.Cookie{
+				Name:     "sessionid",
+				Value:    token,
+				Path:     "/",
+				Expires:  time.Now().Add(1 * time.Hour),
+				HttpOnly: true,
+			})
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, token)))
+	})
+}
+
+// sessionID returns the session token of a request, as set by sessionMiddleware.
+func sessionID(r *http.Request) string {
+	token, _ := r.Context().Value(sessionContextKey{}).(string)
+	return token
+}
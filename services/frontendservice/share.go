@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// SharedCart is a read-only snapshot of someone's shopping cart
+type SharedCart struct {
+	Items   []Item    `json:"items"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	Quote   Quote     `json:"quote"`
+}
+
+func shareCartLink(w http.ResponseWriter, r *http.Request) {
+	sessionid := sessionID(r)
+
+	token, status, err := shareCart(sessionid)
+	if err != nil {
+		log.Error(err)
+		renderError(w, r, status, err)
+		return
+	}
+
+	// The shared page shows the link to pass on
+	http.Redirect(w, r, "/shared/"+token, http.StatusSeeOther)
+}
+
+func sharedCartPage(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	shared, status, err := getSharedCart(token)
+	if err != nil {
+		log.Error(err)
+		renderError(w, r, status, err)
+		return
+	}
+
+	// Build the absolute link to this page
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	link := fmt.Sprintf("%v://%v/shared/%v", scheme, r.Host, token)
+
+	// Render template
+	err = tpl.ExecuteTemplate(w, "shared.html", map[string]interface{}{
+		"token":   token,
+		"link":    link,
+		"expires": shared.Expires.Format("2 January 2006 15:04 MST"),
+		"items":   quoteRows(shared.Quote.Lines),
+		"total":   shared.Quote.Subtotal})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+func copySharedCartItems(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	sessionid := sessionID(r)
+
+	status, err := copySharedCart(sessionid, token)
+	if err != nil {
+		log.Error(err)
+		renderError(w, r, status, err)
+		return
+	}
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+func shareCart(sessionid string) (string, int, error) {
+	url := fmt.Sprintf("%v/cart/%v/share", cartservice, sessionid)
+
+	log.Info("Calling service cartservice...")
+	resp, err := http.Post(url, "application/json", nil)
+	if err != nil {
+		log.Error(err)
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	// Read HTTP body
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err)
+		return "", 0, err
+	}
+
+	if resp.StatusCode != 201 {
+		return "", resp.StatusCode, errors.New(string(result))
+	}
+
+	var share struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(result, &share); err != nil {
+		return "", 0, err
+	}
+
+	return share.Token, 201, nil
+}
+
+func getSharedCart(token string) (SharedCart, int, error) {
+	url := fmt.Sprintf("%v/shared-cart/%v", cartservice, token)
+
+	log.Info("Calling service cartservice...")
+	resp, err := http.Get(url)
+	if err != nil {
+		log.Error(err)
+		return SharedCart{}, 0, err
+	}
+	defer resp.Body.Close()
+
+	// Read HTTP body
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err)
+		return SharedCart{}, 0, err
+	}
+
+	if resp.StatusCode != 200 {
+		return SharedCart{}, resp.StatusCode, errors.New(string(result))
+	}
+
+	var shared SharedCart
+	if err := json.Unmarshal(result, &shared); err != nil {
+		return SharedCart{}, 0, err
+	}
+
+	return shared, 200, nil
+}
+
+func copySharedCart(sessionid, token string) (int, error) {
+	url := fmt.Sprintf("%v/cart/%v/copy?token=%v", cartservice, sessionid, token)
+
+	log.Info("Calling service cartservice...")
+	resp, err := http.Post(url, "application/json", nil)
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Read HTTP body
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+
+	if resp.StatusCode != 201 {
+		return resp.StatusCode, errors.New(string(result))
+	}
+
+	return 201, nil
+}
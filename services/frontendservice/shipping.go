@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ShippingMethod is a way the cart can be shipped, as returned by the checkoutservice
+type ShippingMethod struct {
+	Method  string `json:"method"`
+	Price   int    `json:"price"`
+	Free    bool   `json:"free"`
+	MinDays int    `json:"min_days"`
+	MaxDays int    `json:"max_days"`
+}
+
+// ShippingQuote is what shipping the cart to a country comes down to, as quoted by the checkoutservice:
+// the methods it can be shipped with, and the VAT on the cart there and its total with VAT, before shipping.
+type ShippingQuote struct {
+	Methods []ShippingMethod `json:"methods"`
+	TaxMode string           `json:"tax_mode"`
+	Tax     int              `json:"tax"`
+	Total   int              `json:"total"`
+}
+
+// getShippingQuote calls the checkoutservice to quote shipping the cart to a country.
+func getShippingQuote(sessionid, country string) (ShippingQuote, int, error) {
+	u := fmt.Sprintf("%v/shipping/quote?sessionid=%v&country=%v", checkoutservice, url.QueryEscape(sessionid), url.QueryEscape(country))
+
+	log.Info("Calling service checkoutservice...")
+	resp, err := http.Get(u)
+	if err != nil {
+		log.Error(err)
+		return ShippingQuote{}, 0, err
+	}
+	defer resp.Body.Close()
+
+	// Read HTTP body
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Error(err)
+		return ShippingQuote{}, 0, err
+	}
+
+	if resp.StatusCode != 200 {
+		return ShippingQuote{}, resp.StatusCode, errors.New(string(result))
+	}
+
+	var quote ShippingQuote
+	if err := json.Unmarshal(result, &quote); err != nil {
+		return ShippingQuote{}, 0, err
+	}
+
+	return quote, 200, nil
+}
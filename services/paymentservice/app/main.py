@@ -1,15 +1,102 @@
 from starlette.applications import Starlette
 from starlette.responses import JSONResponse, Response
+import asyncio
+import hashlib
 import uvicorn
 import time
 import uuid
 app = Starlette(debug=False)
 
+# The card number paymentservice declines, so the declined payment flow can be tested
+DECLINED_CARD = "4000000000000002"
+
+# How long a card token can be paid with
+TOKEN_TTL = 30 * 60
+
+# How long a refund is remembered, so retrying it does not refund twice
+REFUND_TTL = 24 * 60 * 60
+
+# How often expired tokens and refunds are cleaned up
+PRUNE_INTERVAL = 60
+
+# The vault of tokenized cards by token, and the tokens handed out by idempotency key and card. It only lives
+# in memory, which is why this service runs a single worker. The security code is checked, but never stored.
+cards = {}
+tokens = {}
+
+# The refunds that were made with their expiry, by transaction ID and reference
+refunds = {}
+
+
+def prune(now):
+    """Forgets the cards, tokens and refunds that have expired."""
+    for token in [t for t, card in cards.items() if card["expires"] < now]:
+        del cards[token]
+    for key in [k for k, token in tokens.items() if token not in cards]:
+        del tokens[key]
+    for key in [k for k, refund in refunds.items() if refund["expires"] < now]:
+        del refunds[key]
+
+
+async def pruner():
+    while True:
+        await asyncio.sleep(PRUNE_INTERVAL)
+        prune(time.time())
+
+
+@app.on_event('startup')
+async def start_pruner():
+    asyncio.ensure_future(pruner())
+
+
+@app.route('/tokenize', methods=['POST'])
+async def tokenize(request):
+    data = await request.json()
+    number = str(data.get("number", "")).replace("-", "").replace(" ", "")
+    cvv = str(data.get("cvv", ""))
+    if not number.isdigit() or not 12 <= len(number) <= 19 or not cvv.isdigit():
+        return JSONResponse({"error": "invalid card"}, 400)
+
+    # The same idempotency key and card get the same token, so a retried checkout stays the same checkout.
+    # Another card is another token, even with the same key, so a declined card can be swapped for another.
+    fingerprint = hashlib.sha256("{}|{}|{}".format(
+        number, data.get("exp_month"), data.get("exp_year")).encode()).hexdigest()
+    key = request.headers.get("Idempotency-Key")
+    if key and tokens.get((key, fingerprint)) in cards:
+        token = tokens[(key, fingerprint)]
+    else:
+        token = "tok_" + uuid.uuid4().hex
+        if key:
+            tokens[(key, fingerprint)] = token
+        cards[token] = {
+            "number": number,
+            "exp_month": data.get("exp_month"),
+            "exp_year": data.get("exp_year"),
+            "brand": data.get("brand", ""),
+            "expires": time.time() + TOKEN_TTL,
+        }
+    payload = {
+        "token": token,
+        "brand": cards[token]["brand"],
+        "last4": number[-4:],
+    }
+    return JSONResponse(payload, 200)
+
 
 @app.route('/payment', methods=['POST'])
 async def index(request):
+    # Look up the card that was tokenized
+    data = await request.json()
+    card = cards.get(data.get("token", ""))
+    if card is None or card["expires"] < time.time():
+        return JSONResponse({"error": "unknown or expired card token"}, 400)
+
     # Simulate a payment processing
-    time.sleep(1)
+    await asyncio.sleep(1)
+
+    # This test card is always declined
+    if card["number"] == DECLINED_CARD:
+        return JSONResponse({"error": "card declined"}, 402)
 
     # Make JSON response
     id = uuid.uuid4()
@@ -20,6 +107,32 @@ async def index(request):
     # Return success, payment processed
     return JSONResponse(payload, 200)
 
+@app.route('/refund', methods=['POST'])
+async def refund(request):
+    # A charge is identified by its transaction ID, or by the reference it was made with
+    data = await request.json()
+    if not data.get("transactionid") and not data.get("reference"):
+        return JSONResponse({"error": "transactionid or reference is required"}, 400)
+
+    # An amount refunds part of the charge, without one the whole charge is refunded
+    amount = data.get("amount")
+    if amount is not None and (not isinstance(amount, int) or amount < 1):
+        return JSONResponse({"error": "amount must be a positive number of cents"}, 400)
+
+    # Simulate a refund, refunding with the same reference twice does nothing
+    await asyncio.sleep(1)
+    key = (data.get("transactionid"), data.get("reference"))
+    if key not in refunds:
+        refunds[key] = {"refundid": str(uuid.uuid4()), "expires": time.time() + REFUND_TTL}
+
+    # Make JSON response
+    payload = {
+        "refundid": refunds[key]["refundid"]
+    }
+
+    # Return success, payment refunded
+    return JSONResponse(payload, 200)
+
 @app.route('/health', methods=['GET'])
 async def healthcheck(request):
 	return Response("OK", 200)
@@ -14,6 +14,13 @@ import (
 	ginlogrus "github.com/toorop/gin-logrus"
 )
 
+// The tax classes a product can be in, which decide the VAT rate it is sold at
+var taxClasses = map[string]bool{
+	"standard": true,
+	"reduced":  true,
+	"zero":     true,
+}
+
 // Product represents the product model
 type Product struct {
 	gorm.Model
@@ -21,6 +28,10 @@ type Product struct {
 	Name        string `json:"name" binding:"required"`
 	Price       int    `json:"price" binding:"required"`
 	Description string `json:"description" binding:"required"`
+	TaxClass    string `json:"tax_class" gorm:"default:'standard'"`
+
+	// Weight is the shipping weight in grams
+	Weight int `json:"weight"`
 }
 
 // getAllProducts fetches all products from the database and returns them as JSON.
@@ -68,6 +79,23 @@ func createProduct(c *gin.Context) {
 		return
 	}
 
+	// Products are taxed at the standard rate unless they say otherwise
+	if product.TaxClass == "" {
+		product.TaxClass = "standard"
+	}
+	if product.Weight < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "weight must not be negative",
+		})
+		return
+	}
+	if !taxClasses[product.TaxClass] {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "tax_class must be one of standard, reduced or zero",
+		})
+		return
+	}
+
 	// Check if the product already exists by checking if there are rows affected
 	if result := db.Where("sku = ?", product.SKU).First(&product).RowsAffected; result == 1 {
 		c.JSON(http.StatusConflict, gin.H{
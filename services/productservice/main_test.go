@@ -47,3 +47,22 @@ func TestGetProduct(t *testing.T) {
 
 	assert.Equal(t, 200, w.Code)
 }
+
+func TestCreateProductInvalidTaxClass(t *testing.T) {
+	router := setupRouter()
+	w := httptest.NewRecorder()
+
+	p := Product{
+		SKU:         "SKU9",
+		Name:        "test9",
+		Price:       22,
+		Description: "used for testing",
+		TaxClass:    "luxury",
+	}
+	pjson, _ := json.Marshal(p)
+
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(pjson))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+}
@@ -1,7 +1,7 @@
 from starlette.applications import Starlette
 from starlette.responses import JSONResponse, Response
 import uvicorn
-import time
+import asyncio
 import uuid
 app = Starlette(debug=False)
 
@@ -9,7 +9,7 @@ app = Starlette(debug=False)
 @app.route('/ship', methods=['POST'])
 async def index(request):
     # Simulate a shipment processing
-    time.sleep(1)
+    await asyncio.sleep(1)
 
     # Make JSON response
     id = uuid.uuid4()
@@ -20,6 +20,19 @@ async def index(request):
     # Return success, payment processed
     return JSONResponse(payload, 200)
 
+@app.route('/cancel', methods=['POST'])
+async def cancel(request):
+    # A shipment is identified by its shipping ID, or by the reference it was made with
+    data = await request.json()
+    if not data.get("shippingid") and not data.get("reference"):
+        return JSONResponse({"error": "shippingid or reference is required"}, 400)
+
+    # Simulate cancelling the shipment, cancelling the same shipment twice does nothing
+    await asyncio.sleep(1)
+
+    # Return success, shipment cancelled
+    return JSONResponse({"status": "cancelled"}, 200)
+
 @app.route('/health', methods=['GET'])
 async def healthcheck(request):
 	return Response("OK", 200)